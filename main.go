@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"simple_pbft/pbft/application"
 	"simple_pbft/pbft/consensus"
 	"simple_pbft/pbft/network"
 	"strconv"
@@ -97,33 +99,137 @@ func monitorPerformance(nodeID string) {
 	}
 }
 
-// 需要输入的参数，nodeID ClusterName ClusterNodeNum ClusterNum
+// 需要输入的参数，nodeID ClusterName ClusterNum ClusterNodeNum [IsMalicious] [MaxBatchSize] [MaxBatchDelay(ms)]
+// 离线校验账本：verify LedgerFile ClusterNodeNum
+// 使用配置文件时：-config ConfigFile nodeID | -config ConfigFile client ClusterName | -config ConfigFile verify LedgerFile
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "-config" {
+		if err := runWithConfig(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := runWithArgs(os.Args[1:]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// runWithConfig 从配置文件读取集群拓扑和参数，args 为配置文件之后的参数
+func runWithConfig(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: -config ConfigFile nodeID | client ClusterName | verify LedgerFile")
+	}
+	configPath := args[0]
+	config, err := network.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if config.KeysDir != "" {
+		network.KeysDir = config.KeysDir
+	}
+	for _, cluster := range config.Clusters {
+		genRsaKeys(cluster.Name)
+	}
+
+	switch args[1] {
+	case "client":
+		if len(args) < 3 {
+			return errors.New("usage: -config ConfigFile client ClusterName")
+		}
+		client, err := network.ClientStartWithConfig(configPath, args[2])
+		if err != nil {
+			return err
+		}
+		go client.SendMsg(sendMsgNumber)
+		client.Start()
+	case "verify":
+		if len(args) < 3 {
+			return errors.New("usage: -config ConfigFile verify LedgerFile")
+		}
+		if err := config.Apply(config.Clusters[0].Name); err != nil {
+			return err
+		}
+		return verifyLedger(args[2])
+	default:
+		nodeID := args[1]
+		server, err := network.NewServerWithConfig(configPath, nodeID)
+		if err != nil {
+			return err
+		}
+		go monitorPerformance(nodeID)
+		server.Start()
+	}
+	return nil
+}
+
+// runWithArgs 按位置参数启动，集群拓扑来自 nodetable.txt
+func runWithArgs(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: nodeID ClusterName ClusterNum ClusterNodeNum [IsMalicious] [MaxBatchSize] [MaxBatchDelay(ms)]")
+	}
 	genRsaKeys("N")
 	genRsaKeys("M")
 	genRsaKeys("P")
 	genRsaKeys("J")
 	genRsaKeys("K")
-	nodeID := os.Args[1]
-	clusterName := os.Args[2]
-	sendMsgNumber := 1
+	nodeID := args[0]
+	clusterName := args[1]
 	if nodeID == "client" {
 		client := network.ClientStart(clusterName)
 
 		go client.SendMsg(sendMsgNumber)
 
 		client.Start()
+	} else if nodeID == "verify" {
+		if len(args) > 2 {
+			nodeNum, err := positiveArg(args[2], "ClusterNodeNum")
+			if err != nil {
+				return err
+			}
+			consensus.F = (nodeNum - 1) / 3
+		}
+		return verifyLedger(args[1])
 	} else {
-		nodeNumStr := os.Args[4]
-		// 将字符串转换为整数
-		nodeNum, _ := strconv.Atoi(nodeNumStr)
+		if len(args) < 4 {
+			return errors.New("usage: nodeID ClusterName ClusterNum ClusterNodeNum [IsMalicious] [MaxBatchSize] [MaxBatchDelay(ms)]")
+		}
+		nodeNum, err := positiveArg(args[3], "ClusterNodeNum")
+		if err != nil {
+			return err
+		}
+		if nodeNum < 4 {
+			return fmt.Errorf("ClusterNodeNum %d cannot tolerate any faulty node, need at least 4", nodeNum)
+		}
 		consensus.F = (nodeNum - 1) / 3
-		network.ClusterNumber, _ = strconv.Atoi(os.Args[3])
-		// 设置默认值
-		// 检查是否提供了第5个参数
-		if len(os.Args) > 5 { // 判断节点是正常节点还是恶意节点
-			network.IsMaliciousNode = os.Args[5] // 使用提供的第三个参数
-			//fmt.Println("get args 5")
+		network.ClusterNumber, err = positiveArg(args[2], "ClusterNum")
+		if err != nil {
+			return err
+		}
+		if network.ClusterNumber > len(network.Allcluster) {
+			return fmt.Errorf("ClusterNum %d exceeds the %d known clusters", network.ClusterNumber, len(network.Allcluster))
+		}
+		// 判断节点是正常节点还是恶意节点
+		// "No" 为正常节点，"Yes" 或以逗号分隔的拜占庭行为(如 equivocate,delay)为恶意节点
+		if len(args) > 4 {
+			if _, err := network.ParseBehaviours(args[4]); err != nil {
+				return err
+			}
+			network.IsMaliciousNode = args[4]
+		}
+		// 第6、7个参数为批次的最大请求数和最长等待时间(毫秒)，用于测试吞吐量和延迟的权衡
+		if len(args) > 5 {
+			if consensus.MaxBatchSize, err = positiveArg(args[5], "MaxBatchSize"); err != nil {
+				return err
+			}
+		}
+		if len(args) > 6 {
+			delay, err := strconv.Atoi(args[6])
+			if err != nil || delay < 0 {
+				return fmt.Errorf("MaxBatchDelay must be a non-negative number of milliseconds, got %q", args[6])
+			}
+			consensus.MaxBatchDelay = time.Duration(delay) * time.Millisecond
 		}
 
 		//监测内存使用情况
@@ -133,5 +239,33 @@ func main() {
 
 		server.Start()
 	}
+	return nil
+}
+
+// sendMsgNumber 每个客户端发送的请求数
+var sendMsgNumber = 1
+
+func init() {
+	// 使用键值存储作为复制状态机
+	network.NewStateMachine = func() application.StateMachine {
+		return application.NewKVStore()
+	}
+}
 
+func verifyLedger(path string) error {
+	verified, err := network.VerifyLedger(path)
+	if err != nil {
+		return fmt.Errorf("账本校验失败，前 %d 个区块有效: %s", verified, err)
+	}
+	fmt.Printf("账本校验通过，共 %d 个区块\n", verified)
+	return nil
+}
+
+// positiveArg 把参数 name 解析为正整数
+func positiveArg(arg string, name string) (int, error) {
+	value, err := strconv.Atoi(arg)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", name, arg)
+	}
+	return value, nil
 }
@@ -0,0 +1,40 @@
+package application
+
+import "simple_pbft/pbft/consensus"
+
+// StateMachine 是运行在 geo-PBFT 之上的复制状态机。
+// 每个副本都按全局共识确定的顺序对每个已提交的请求调用 Execute，
+// 因此实现必须是确定性的：相同的请求序列必须得到相同的状态和结果。
+type StateMachine interface {
+	// Execute 执行一个已经全局排序的请求，返回值作为 ReplyMsg.Result 返回给客户端
+	Execute(request *consensus.RequestMsg) string
+	// Query 只读查询，不经过共识，也不改变状态
+	Query(query string) (string, error)
+	// Snapshot 返回当前状态的序列化快照，用于检查点和状态传输
+	Snapshot() ([]byte, error)
+	// Restore 用快照替换当前状态
+	Restore(snapshot []byte) error
+}
+
+// NoopApp 不维护任何状态，每个请求都返回 "Executed"
+type NoopApp struct{}
+
+func NewNoopApp() *NoopApp {
+	return &NoopApp{}
+}
+
+func (app *NoopApp) Execute(request *consensus.RequestMsg) string {
+	return "Executed"
+}
+
+func (app *NoopApp) Query(query string) (string, error) {
+	return "", nil
+}
+
+func (app *NoopApp) Snapshot() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (app *NoopApp) Restore(snapshot []byte) error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"strings"
+	"sync"
+)
+
+// KVStore 是参考实现的键值存储状态机，请求的 Operation 为以下命令之一：
+//
+//	GET <key>
+//	PUT <key> <value>
+//	DELETE <key>
+//	CAS <key> <expected> <value>
+//
+// 所有副本按相同顺序执行相同的命令后应持有完全相同的 map，可用 Query("DIGEST") 比较
+type KVStore struct {
+	data map[string]string
+	lock sync.RWMutex
+}
+
+const (
+	ResultOK        = "OK"
+	ResultNotFound  = "NOT_FOUND"
+	ResultCASFailed = "CAS_FAILED"
+)
+
+func NewKVStore() *KVStore {
+	return &KVStore{
+		data: make(map[string]string),
+	}
+}
+
+func (kv *KVStore) Execute(request *consensus.RequestMsg) string {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	args := strings.Fields(request.Operation)
+	if len(args) == 0 {
+		return "ERR empty command"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) != 2 {
+			return "ERR usage: GET <key>"
+		}
+		return kv.get(args[1])
+	case "PUT":
+		if len(args) < 3 {
+			return "ERR usage: PUT <key> <value>"
+		}
+		kv.data[args[1]] = strings.Join(args[2:], " ")
+		return ResultOK
+	case "DELETE":
+		if len(args) != 2 {
+			return "ERR usage: DELETE <key>"
+		}
+		if _, ok := kv.data[args[1]]; !ok {
+			return ResultNotFound
+		}
+		delete(kv.data, args[1])
+		return ResultOK
+	case "CAS":
+		if len(args) < 4 {
+			return "ERR usage: CAS <key> <expected> <value>"
+		}
+		value, ok := kv.data[args[1]]
+		if !ok || value != args[2] {
+			return ResultCASFailed
+		}
+		kv.data[args[1]] = strings.Join(args[3:], " ")
+		return ResultOK
+	}
+
+	return fmt.Sprintf("ERR unknown command %s", args[0])
+}
+
+// Query 支持 GET <key> 和 DIGEST，DIGEST 返回当前整个 map 的摘要
+func (kv *KVStore) Query(query string) (string, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	args := strings.Fields(query)
+	if len(args) == 2 && strings.ToUpper(args[0]) == "GET" {
+		return kv.get(args[1]), nil
+	}
+	if len(args) == 1 && strings.ToUpper(args[0]) == "DIGEST" {
+		snapshot, err := json.Marshal(kv.data)
+		if err != nil {
+			return "", err
+		}
+		return consensus.Hash(snapshot), nil
+	}
+
+	return "", fmt.Errorf("unsupported query: %s", query)
+}
+
+// Snapshot 以 JSON 形式导出整个 map，encoding/json 会对 key 排序，因此结果是确定的
+func (kv *KVStore) Snapshot() ([]byte, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	return json.Marshal(kv.data)
+}
+
+func (kv *KVStore) Restore(snapshot []byte) error {
+	data := make(map[string]string)
+	if len(snapshot) > 0 {
+		if err := json.Unmarshal(snapshot, &data); err != nil {
+			return err
+		}
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.data = data
+	return nil
+}
+
+func (kv *KVStore) get(key string) string {
+	value, ok := kv.data[key]
+	if !ok {
+		return ResultNotFound
+	}
+	return value
+}
@@ -0,0 +1,128 @@
+package application
+
+import (
+	"simple_pbft/pbft/consensus"
+	"testing"
+)
+
+func execute(kv *KVStore, operation string) string {
+	return kv.Execute(&consensus.RequestMsg{Operation: operation})
+}
+
+func TestKVStoreExecute(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  []string
+		op     string
+		result string
+		get    string // 执行后 GET 该键的结果，为空时不检查
+		value  string
+	}{
+		{name: "get missing", op: "GET a", result: ResultNotFound},
+		{name: "put", op: "PUT a 1", result: ResultOK, get: "a", value: "1"},
+		{name: "put value with spaces", op: "PUT a x  y", result: ResultOK, get: "a", value: "x y"},
+		{name: "put overwrites", setup: []string{"PUT a 1"}, op: "PUT a 2", result: ResultOK, get: "a", value: "2"},
+		{name: "get", setup: []string{"PUT a 1"}, op: "GET a", result: "1"},
+		{name: "lower case command", setup: []string{"put a 1"}, op: "get a", result: "1"},
+		{name: "delete", setup: []string{"PUT a 1"}, op: "DELETE a", result: ResultOK, get: "a", value: ResultNotFound},
+		{name: "delete missing", op: "DELETE a", result: ResultNotFound},
+		{name: "cas", setup: []string{"PUT a 1"}, op: "CAS a 1 2", result: ResultOK, get: "a", value: "2"},
+		{name: "cas mismatch", setup: []string{"PUT a 1"}, op: "CAS a 3 2", result: ResultCASFailed, get: "a", value: "1"},
+		{name: "cas missing", op: "CAS a 1 2", result: ResultCASFailed, get: "a", value: ResultNotFound},
+		{name: "empty", op: "  ", result: "ERR empty command"},
+		{name: "get usage", op: "GET", result: "ERR usage: GET <key>"},
+		{name: "put usage", op: "PUT a", result: "ERR usage: PUT <key> <value>"},
+		{name: "delete usage", op: "DELETE a b", result: "ERR usage: DELETE <key>"},
+		{name: "cas usage", op: "CAS a 1", result: "ERR usage: CAS <key> <expected> <value>"},
+		{name: "unknown", op: "INCR a", result: "ERR unknown command INCR"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kv := NewKVStore()
+			for _, op := range test.setup {
+				execute(kv, op)
+			}
+			if result := execute(kv, test.op); result != test.result {
+				t.Fatalf("%q returns %q, expect %q", test.op, result, test.result)
+			}
+			if test.get == "" {
+				return
+			}
+			if value, _ := kv.Query("GET " + test.get); value != test.value {
+				t.Fatalf("GET %s returns %q after %q, expect %q", test.get, value, test.op, test.value)
+			}
+		})
+	}
+}
+
+func TestKVStoreDigestDeterministic(t *testing.T) {
+	ops := []string{"PUT b 2", "PUT a 1", "CAS a 1 3", "PUT c 4", "DELETE c", "GET a"}
+
+	// 两个副本按相同顺序执行相同的命令得到相同的摘要
+	first, second := NewKVStore(), NewKVStore()
+	for _, op := range ops {
+		if r1, r2 := execute(first, op), execute(second, op); r1 != r2 {
+			t.Fatalf("%q returns %q and %q on two replicas", op, r1, r2)
+		}
+	}
+	digest, err := first.Query("DIGEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := second.Query("DIGEST"); other != digest {
+		t.Fatalf("digests %s and %s differ after the same commands", digest, other)
+	}
+
+	// 摘要只取决于最终状态，与插入顺序无关
+	reordered := NewKVStore()
+	execute(reordered, "PUT a 3")
+	execute(reordered, "PUT b 2")
+	if other, _ := reordered.Query("DIGEST"); other != digest {
+		t.Fatalf("digest %s of the same map in another insertion order, expect %s", other, digest)
+	}
+
+	// 不同的状态得到不同的摘要
+	execute(reordered, "PUT b 5")
+	if other, _ := reordered.Query("DIGEST"); other == digest {
+		t.Fatalf("different maps have the same digest %s", digest)
+	}
+
+	// 从快照恢复的副本与原副本摘要相同
+	snapshot, err := first.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewKVStore()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := restored.Query("DIGEST"); other != digest {
+		t.Fatalf("restored digest %s, expect %s", other, digest)
+	}
+}
+
+func TestKVStoreQuery(t *testing.T) {
+	kv := NewKVStore()
+	execute(kv, "PUT a 1")
+	tests := []struct {
+		query  string
+		result string
+		err    bool
+	}{
+		{query: "GET a", result: "1"},
+		{query: "GET b", result: ResultNotFound},
+		{query: "PUT a 2", err: true},
+		{query: "GET", err: true},
+		{query: "", err: true},
+	}
+	for _, test := range tests {
+		result, err := kv.Query(test.query)
+		if (err != nil) != test.err || result != test.result {
+			t.Fatalf("query %q returns %q, %v", test.query, result, err)
+		}
+	}
+	// 查询不会修改状态
+	if value, _ := kv.Query("GET a"); value != "1" {
+		t.Fatalf("query modified the store, GET a returns %q", value)
+	}
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"simple_pbft/pbft/consensus"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout 等待 f+1 个相同 reply 的初始超时时间，每次重传后翻倍
+const DefaultTimeout = 5 * time.Second
+
+// ErrTimeout 重传 MaxRetries 次后仍未收到 f+1 个相同的结果
+var ErrTimeout = errors.New("request timed out")
+
+// Client 向本集群的主节点提交请求，并等待 f+1 个副本返回相同的执行结果
+type Client struct {
+	ClientID  string
+	Cluster   string
+	URL       string                       // 接收 reply 消息的监听地址
+	NodeTable map[string]map[string]string // cluster - nodeID - url
+	F         int
+
+	// 超时后先向主节点重传 PrimaryRetries 次，之后广播给集群内所有副本，
+	// 副本会把请求转发给主节点并启动视图切换计时器。MaxRetries 为 0 表示一直重传直到 ctx 结束
+	Timeout        time.Duration
+	PrimaryRetries int
+	MaxRetries     int
+
+	// ErrorLog 记录重传和处理 reply 时的错误，为 nil 时不记录
+	ErrorLog *log.Logger
+
+	view          int64  // 从 reply 中得知的集群最新视图编号，用于确定主节点
+	viewPrimary   string // reply 中附带的该视图的主节点，集群按信誉选举主节点后不再按编号轮换
+	lastTimestamp int64
+	pending       map[int64]*pendingRequest // timestamp - request
+	lock          sync.Mutex
+}
+
+type pendingRequest struct {
+	msg     *consensus.RequestMsg
+	replies map[string]string // nodeID - result
+	result  string
+	done    chan struct{}
+}
+
+func NewClient(clientID string, cluster string, url string, nodeTable map[string]map[string]string, f int) *Client {
+	return &Client{
+		ClientID:  clientID,
+		Cluster:   cluster,
+		URL:       url,
+		NodeTable: nodeTable,
+		F:         f,
+
+		Timeout:        DefaultTimeout,
+		PrimaryRetries: 1,
+
+		pending: make(map[int64]*pendingRequest),
+	}
+}
+
+// Start 在 URL 上监听副本发来的 reply 消息
+func (client *Client) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reply", client.HandleReply)
+	return http.ListenAndServe(client.URL, mux)
+}
+
+// Submit 提交一个操作并阻塞，直到 f+1 个副本返回相同的结果或 ctx 结束
+func (client *Client) Submit(ctx context.Context, operation string) (string, error) {
+	timestamp, err := client.Send(operation)
+	if timestamp == 0 {
+		return "", err
+	}
+	if err != nil {
+		// 发送失败由 Wait 中的超时重传处理
+		client.logf("send request %d: %s", timestamp, err)
+	}
+	return client.Wait(ctx, timestamp)
+}
+
+// Send 为操作分配一个递增的时间戳并发送给主节点，返回该时间戳用于 Wait。
+// 只要返回的时间戳不为 0，即使发送出错请求也已登记，Wait 会负责重传
+func (client *Client) Send(operation string) (int64, error) {
+	client.lock.Lock()
+	timestamp := time.Now().UnixNano()
+	if timestamp <= client.lastTimestamp {
+		timestamp = client.lastTimestamp + 1
+	}
+	client.lastTimestamp = timestamp
+
+	msg := &consensus.RequestMsg{
+		Timestamp: timestamp,
+		ClientID:  client.ClientID,
+		Operation: operation,
+		URL:       client.URL,
+	}
+	client.pending[timestamp] = &pendingRequest{
+		msg:     msg,
+		replies: make(map[string]string),
+		done:    make(chan struct{}),
+	}
+	client.lock.Unlock()
+
+	return timestamp, client.sendToPrimary(msg)
+}
+
+// Wait 等待时间戳为 timestamp 的请求收到 f+1 个相同的结果
+func (client *Client) Wait(ctx context.Context, timestamp int64) (string, error) {
+	client.lock.Lock()
+	request, ok := client.pending[timestamp]
+	client.lock.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no pending request with timestamp %d", timestamp)
+	}
+
+	defer func() {
+		client.lock.Lock()
+		delete(client.pending, timestamp)
+		client.lock.Unlock()
+	}()
+
+	timeout := client.Timeout
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-request.done:
+			timer.Stop()
+			return request.result, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-timer.C:
+		}
+
+		if client.MaxRetries > 0 && attempt > client.MaxRetries {
+			return "", ErrTimeout
+		}
+		client.retransmit(request.msg, attempt)
+		timeout *= 2
+	}
+}
+
+// retransmit 第 attempt 次超时后重传请求，先发给主节点，仍然超时则广播给集群内所有副本
+func (client *Client) retransmit(msg *consensus.RequestMsg, attempt int) {
+	if attempt <= client.PrimaryRetries {
+		client.logf("request %d timed out, retransmit to primary", msg.Timestamp)
+		if err := client.sendToPrimary(msg); err != nil {
+			client.logf("retransmit request %d: %s", msg.Timestamp, err)
+		}
+		return
+	}
+
+	client.logf("request %d timed out, broadcast to all replicas", msg.Timestamp)
+	if err := client.broadcast(msg); err != nil {
+		client.logf("broadcast request %d: %s", msg.Timestamp, err)
+	}
+}
+
+// sendToPrimary 把请求发给主节点，还不知道主节点时广播给集群内所有副本，由副本转发给主节点
+func (client *Client) sendToPrimary(msg *consensus.RequestMsg) error {
+	client.lock.Lock()
+	primary := client.primary()
+	client.lock.Unlock()
+
+	if primary == "" {
+		return client.broadcast(msg)
+	}
+	url, ok := client.NodeTable[client.Cluster][primary]
+	if !ok {
+		return fmt.Errorf("primary %s not found in node table", primary)
+	}
+	return post(url+"/req", msg)
+}
+
+// broadcast 把请求发给集群内所有副本，只要有一个副本收到就不返回错误
+func (client *Client) broadcast(msg *consensus.RequestMsg) error {
+	var lastErr error
+	sent := false
+	for nodeID, url := range client.NodeTable[client.Cluster] {
+		if err := post(url+"/req", msg); err != nil {
+			lastErr = fmt.Errorf("send to %s: %s", nodeID, err)
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no replica of cluster %s in node table", client.Cluster)
+	}
+	return lastErr
+}
+
+// HandleReply 处理副本发来的 reply 消息，同一请求收到 f+1 个相同结果后唤醒 Wait
+func (client *Client) HandleReply(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.ReplyMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := client.GetReply(&msg); err != nil {
+		client.logf("%s", err)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (client *Client) GetReply(msg *consensus.ReplyMsg) error {
+	if msg.ClientID != client.ClientID {
+		return fmt.Errorf("reply for other client %s", msg.ClientID)
+	}
+	if _, ok := client.NodeTable[client.Cluster][msg.NodeID]; !ok {
+		return fmt.Errorf("reply from unknown node %s", msg.NodeID)
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if msg.ViewID > client.view || (msg.ViewID == client.view && client.viewPrimary == "") {
+		client.view = msg.ViewID
+		client.viewPrimary = ""
+		if _, ok := client.NodeTable[client.Cluster][msg.Primary]; ok {
+			client.viewPrimary = msg.Primary
+		}
+	}
+
+	request, ok := client.pending[msg.Timestamp]
+	if !ok || request.isDone() {
+		return nil
+	}
+	request.replies[msg.NodeID] = msg.Result
+
+	matching := 0
+	for _, result := range request.replies {
+		if result == msg.Result {
+			matching++
+		}
+	}
+	if matching >= client.F+1 {
+		request.result = msg.Result
+		close(request.done)
+	}
+	return nil
+}
+
+// primary 优先使用 reply 中附带的主节点。还没有收到 reply 时按 PrimaryOf 的规则，视图 0 的主节点是
+// 委员会的第一个节点 cluster0；之后的视图由委员会和选举结果决定，客户端无法推算，返回空字符串表示需要广播。
+// 调用时需持有 lock
+func (client *Client) primary() string {
+	if client.viewPrimary != "" {
+		return client.viewPrimary
+	}
+	if client.view == 0 {
+		return client.Cluster + "0"
+	}
+	return ""
+}
+
+func (client *Client) logf(format string, args ...interface{}) {
+	if client.ErrorLog != nil {
+		client.ErrorLog.Printf(format, args...)
+	}
+}
+
+func (request *pendingRequest) isDone() bool {
+	select {
+	case <-request.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func post(url string, msg interface{}) error {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post("http://"+url, "application/json", bytes.NewBuffer(jsonMsg))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
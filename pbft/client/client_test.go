@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"simple_pbft/pbft/consensus"
+	"testing"
+	"time"
+)
+
+// newTestClient 创建集群 N 中 f = 1 的客户端，节点表中的地址不可达，发送请求都会失败
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	nodeTable := map[string]map[string]string{
+		"N": {"N0": "127.0.0.1:1", "N1": "127.0.0.1:1", "N2": "127.0.0.1:1", "N3": "127.0.0.1:1"},
+	}
+	client := NewClient("Client-N", "N", "127.0.0.1:1", nodeTable, 1)
+	client.Timeout = time.Hour
+	return client
+}
+
+// sendTestRequest 登记一个请求并返回它的时间戳，发送失败不影响等待 reply
+func sendTestRequest(t *testing.T, client *Client) int64 {
+	t.Helper()
+	timestamp, _ := client.Send("PUT a 1")
+	if timestamp == 0 {
+		t.Fatal("request is not registered")
+	}
+	return timestamp
+}
+
+func reply(timestamp int64, nodeID string, result string) *consensus.ReplyMsg {
+	return &consensus.ReplyMsg{Timestamp: timestamp, ClientID: "Client-N", NodeID: nodeID, Result: result}
+}
+
+// waitResult 在 timeout 内等待请求完成，超时返回 context.DeadlineExceeded
+func waitResult(client *Client, timestamp int64, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.Wait(ctx, timestamp)
+}
+
+func TestReplyQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []*consensus.ReplyMsg
+		result  string // 为空时请求不应完成
+	}{
+		{
+			name:    "f+1 matching replies",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "OK"), reply(0, "N1", "OK")},
+			result:  "OK",
+		},
+		{
+			name:    "single reply",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "OK")},
+		},
+		{
+			name:    "duplicate replies from the same replica",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "OK"), reply(0, "N0", "OK"), reply(0, "N0", "OK")},
+		},
+		{
+			name:    "mismatched replies",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "OK"), reply(0, "N1", "BAD")},
+		},
+		{
+			name:    "matching replies after a mismatch",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "BAD"), reply(0, "N1", "OK"), reply(0, "N2", "OK")},
+			result:  "OK",
+		},
+		{
+			// 同一副本发出的不同结果只算一个副本
+			name:    "replica changes its result",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "OK"), reply(0, "N0", "BAD"), reply(0, "N1", "OK")},
+		},
+		{
+			name:    "replies from unknown nodes",
+			replies: []*consensus.ReplyMsg{reply(0, "N0", "OK"), reply(0, "X9", "OK"), reply(0, "M1", "OK")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t)
+			timestamp := sendTestRequest(t, client)
+			for _, msg := range test.replies {
+				msg.Timestamp = timestamp
+				client.GetReply(msg)
+			}
+
+			if test.result == "" {
+				if result, err := waitResult(client, timestamp, 50*time.Millisecond); err != context.DeadlineExceeded {
+					t.Fatalf("request completes with %q, %v", result, err)
+				}
+				return
+			}
+			result, err := waitResult(client, timestamp, time.Second)
+			if err != nil || result != test.result {
+				t.Fatalf("request completes with %q, %v, expect %q", result, err, test.result)
+			}
+		})
+	}
+}
+
+func TestReplyForOtherRequest(t *testing.T) {
+	client := newTestClient(t)
+	first := sendTestRequest(t, client)
+	second := sendTestRequest(t, client)
+
+	// 不同请求的 reply 不能凑成同一个请求的法定人数
+	client.GetReply(reply(first, "N0", "OK"))
+	client.GetReply(reply(second, "N1", "OK"))
+	if err := client.GetReply(&consensus.ReplyMsg{Timestamp: first, ClientID: "Client-M", NodeID: "N2", Result: "OK"}); err == nil {
+		t.Fatal("reply for another client is accepted")
+	}
+	if result, err := waitResult(client, first, 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("request completes with %q, %v", result, err)
+	}
+
+	client.GetReply(reply(second, "N3", "OK"))
+	if result, err := waitResult(client, second, time.Second); err != nil || result != "OK" {
+		t.Fatalf("request completes with %q, %v, expect OK", result, err)
+	}
+}
+
+func TestReplyUpdatesPrimary(t *testing.T) {
+	client := newTestClient(t)
+	if primary := client.primary(); primary != "N0" {
+		t.Fatalf("primary of view 0 is %s, expect N0", primary)
+	}
+
+	msg := reply(0, "N1", "OK")
+	msg.ViewID, msg.Primary = 1001, "N3"
+	client.GetReply(msg)
+	if primary := client.primary(); primary != "N3" {
+		t.Fatalf("primary is %s after reply from view 1001, expect N3", primary)
+	}
+
+	// reply 中的主节点不在节点表中时不知道主节点，请求需要广播
+	msg = reply(0, "N1", "OK")
+	msg.ViewID, msg.Primary = 1002, "X9"
+	client.GetReply(msg)
+	if primary := client.primary(); primary != "" {
+		t.Fatalf("primary is %s after reply with unknown primary, expect broadcast", primary)
+	}
+}
@@ -0,0 +1,154 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Block 一个全局轮次执行的所有批次，区块之间通过 PrevHash 链接成账本
+type Block struct {
+	Height     int64         `json:"height"` // 全局轮次对应的序号，从 1 开始
+	ViewID     int64         `json:"viewID"`
+	PrevHash   string        `json:"prevHash"`
+	MerkleRoot string        `json:"merkleRoot"` // 区块中所有请求按执行顺序计算的 Merkle 根
+	Hash       string        `json:"hash"`
+	Batches    []*BlockBatch `json:"batches"` // 按 ExecutionOrder 排列
+}
+
+// BlockBatch 某个集群在该轮次提交的批次及其证明，每个批次附带其所在集群 2f+1 条 commit 投票，
+// 其他集群的批次还附带其主节点的签名
+type BlockBatch struct {
+	Cluster    string           `json:"ClusterName"`
+	RequestMsg *BatchRequestMsg `json:"requestMsg"`
+	Digest     string           `json:"digest"`
+	CommitMsgs []*VoteMsg       `json:"commitMsgs,omitempty"`
+	NodeID     string           `json:"nodeID,omitempty"`
+	ViewNumber int64            `json:"viewNumber,omitempty"`
+	Sign       []byte           `json:"sign,omitempty"`
+}
+
+// blockHeader 区块哈希只覆盖区块头，各节点收集到的证明可能不同，但区块哈希相同。
+// Merkle 根只覆盖请求，区块头还记录每个批次的集群和摘要，批次摘要覆盖参与报告等批次元数据
+type blockHeader struct {
+	Height     int64         `json:"height"`
+	ViewID     int64         `json:"viewID"`
+	PrevHash   string        `json:"prevHash"`
+	MerkleRoot string        `json:"merkleRoot"`
+	Batches    []batchHeader `json:"batches"`
+}
+
+// batchHeader 区块头中一个批次所在的集群和批次摘要
+type batchHeader struct {
+	Cluster string `json:"cluster"`
+	Digest  string `json:"digest"`
+}
+
+// NewBlock 创建高度为 height 的区块并计算 Merkle 根和区块哈希
+func NewBlock(height int64, viewID int64, prevHash string, batches []*BlockBatch) *Block {
+	block := &Block{
+		Height:   height,
+		ViewID:   viewID,
+		PrevHash: prevHash,
+		Batches:  batches,
+	}
+	block.MerkleRoot = MerkleRoot(block.Requests())
+	block.Hash = block.ComputeHash()
+	return block
+}
+
+// Requests 按执行顺序返回区块中的所有请求
+func (block *Block) Requests() []*RequestMsg {
+	requests := make([]*RequestMsg, 0)
+	for _, batch := range block.Batches {
+		if batch.RequestMsg != nil {
+			requests = append(requests, batch.RequestMsg.Requests...)
+		}
+	}
+	return requests
+}
+
+func (block *Block) ComputeHash() string {
+	batches := make([]batchHeader, 0, len(block.Batches))
+	for _, batch := range block.Batches {
+		batches = append(batches, batchHeader{Cluster: batch.Cluster, Digest: batch.Digest})
+	}
+	header, _ := json.Marshal(&blockHeader{
+		Height:     block.Height,
+		ViewID:     block.ViewID,
+		PrevHash:   block.PrevHash,
+		MerkleRoot: block.MerkleRoot,
+		Batches:    batches,
+	})
+	return Hash(header)
+}
+
+// Verify 检查区块与前一个区块的链接、Merkle 根、区块哈希以及每个批次的摘要，不检查签名
+func (block *Block) Verify(prevHash string) error {
+	if block.PrevHash != prevHash {
+		return fmt.Errorf("block %d: previous hash mismatch", block.Height)
+	}
+	if block.MerkleRoot != MerkleRoot(block.Requests()) {
+		return fmt.Errorf("block %d: merkle root mismatch", block.Height)
+	}
+	if block.Hash != block.ComputeHash() {
+		return fmt.Errorf("block %d: hash mismatch", block.Height)
+	}
+	for i, batch := range block.Batches {
+		if i > 0 && batch.Cluster <= block.Batches[i-1].Cluster {
+			return fmt.Errorf("block %d: batch of %s is out of execution order", block.Height, batch.Cluster)
+		}
+		if batch.RequestMsg == nil {
+			return fmt.Errorf("block %d: empty batch of %s", block.Height, batch.Cluster)
+		}
+		batchDigest, err := digest(batch.RequestMsg)
+		if err != nil {
+			return err
+		}
+		if batchDigest != batch.Digest {
+			return fmt.Errorf("block %d: batch digest of %s mismatch", block.Height, batch.Cluster)
+		}
+	}
+	return nil
+}
+
+// ExecutionOrder 一个全局轮次内各集群批次的执行顺序：按集群 ID 排序，批次内按请求在批次中的顺序，
+// 与各节点配置中集群的排列顺序无关
+func ExecutionOrder(clusters []string) []string {
+	order := append([]string(nil), clusters...)
+	sort.Strings(order)
+	return order
+}
+
+// Merkle 树中叶子和内部节点哈希前的前缀
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// MerkleRoot 以每个请求的哈希为叶子两两哈希，没有请求时返回空字符串。叶子和内部节点使用不同的前缀，
+// 某一层有奇数个节点时最后一个直接进入上一层而不是复制，因此不同的请求列表不会得到相同的根
+func MerkleRoot(requests []*RequestMsg) string {
+	if len(requests) == 0 {
+		return ""
+	}
+	level := make([]string, 0, len(requests))
+	for _, request := range requests {
+		jsonMsg, err := json.Marshal(request)
+		if err != nil {
+			return ""
+		}
+		level = append(level, Hash(append([]byte{merkleLeafPrefix}, jsonMsg...)))
+	}
+	for len(level) > 1 {
+		next := make([]string, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, Hash(append([]byte{merkleNodePrefix}, level[i]+level[i+1]...)))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+	return level[0]
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -12,16 +13,24 @@ type State struct {
 	MsgLogs        *MsgLogs
 	LastSequenceID int64
 	CurrentStage   Stage
+	LowWatermark   int64 // 最新稳定检查点的序号 h
+	HighWatermark  int64 // h + WatermarkWindow
+	// 可以投票的委员会节点，法定人数只按委员会的大小计算，为空时接受所有节点的投票并使用 F
+	Committee map[string]bool
 }
 
 type GlobalLog struct {
 	MsgLogs map[string]map[int64]*BatchRequestMsg // cluster - ViewID - msg
+	Shares  map[string]map[int64]*GlobalShareMsg  // 其他集群主节点签名的消息，状态传输时转发给落后的节点
+	Certs   map[int64]*CommitCert                 // ViewID - 本集群批次的 commit 证明，执行时写入区块
+	Lock    sync.RWMutex
 }
 
 type MsgLogs struct {
-	ReqMsg      *BatchRequestMsg
-	PrepareMsgs map[string]*VoteMsg
-	CommitMsgs  map[string]*VoteMsg
+	ReqMsg        *BatchRequestMsg
+	PrePrepareMsg *PrePrepareMsg // 视图切换时作为 prepared 证明的一部分
+	PrepareMsgs   map[string]*VoteMsg
+	CommitMsgs    map[string]*VoteMsg
 }
 
 type Stage int
@@ -34,12 +43,20 @@ const (
 	GetRequest
 )
 
+// 每执行 CheckpointPeriod 个全局轮次生成一次检查点，序号只能落在 (h, h + WatermarkWindow] 之间
+const CheckpointPeriod = 10
+const WatermarkWindow = 2 * CheckpointPeriod
+
+// 主节点缓存的请求达到 MaxBatchSize 个，或最早的请求等待超过 MaxBatchDelay 时打包成一个批次
+var MaxBatchSize = 1
+var MaxBatchDelay = 10 * time.Millisecond
+
 // f: # of Byzantine faulty node
 // f = (n­1) / 3
 // n = 4, in this case.
 var F = 1
 
-// lastSequenceID will be -1 if there is no last sequence ID.
+// lastSequenceID is the sequence ID of the last committed request, 0 if there is none.
 func CreateState(viewID int64, lastSequenceID int64) *State {
 	return &State{
 		ViewID: viewID,
@@ -53,22 +70,30 @@ func CreateState(viewID int64, lastSequenceID int64) *State {
 	}
 }
 
+// SetWatermarks 以最新稳定检查点的序号作为低水位
+func (state *State) SetWatermarks(low int64) {
+	state.LowWatermark = low
+	state.HighWatermark = low + WatermarkWindow
+}
+
+// SetCommittee 设置本实例中可以投票的委员会节点，其他节点(观察节点)的投票被拒绝
+func (state *State) SetCommittee(members []string) {
+	state.Committee = make(map[string]bool, len(members))
+	for _, member := range members {
+		state.Committee[member] = true
+	}
+}
+
 func (state *State) StartConsensus(request *BatchRequestMsg) (*PrePrepareMsg, error) {
 	// `sequenceID` will be the index of this message.
-	sequenceID := time.Now().UnixNano()
-	// fmt.Printf("test import where")
-	// Find the unique and largest number for the sequence ID
-	if state.LastSequenceID != -1 {
-		for state.LastSequenceID >= sequenceID {
-			sequenceID += 1
-		}
-	}
+	// 主节点按顺序分配连续的序号，紧接在上一个已提交的序号之后
+	sequenceID := state.LastSequenceID + 1
 
 	// Assign a new sequence ID to the request message object.
 	for _, value := range request.Requests {
 		value.SequenceID = sequenceID
 	}
-	//request.SequenceID = sequenceID
+	request.SequenceID = sequenceID
 
 	// Save ReqMsgs to its logs.
 	state.MsgLogs.ReqMsg = request
@@ -83,24 +108,36 @@ func (state *State) StartConsensus(request *BatchRequestMsg) (*PrePrepareMsg, er
 	// Change the stage to pre-prepared.
 	state.CurrentStage = PrePrepared
 
-	return &PrePrepareMsg{
+	state.MsgLogs.PrePrepareMsg = &PrePrepareMsg{
 		ViewID:     state.ViewID,
 		SequenceID: sequenceID,
 		Digest:     digest,
 		RequestMsg: request,
-	}, nil
+	}
+
+	return state.MsgLogs.PrePrepareMsg, nil
 }
 
 func (state *State) PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error) {
 	// Get ReqMsgs and save it to its logs like the primary.
 	state.MsgLogs.ReqMsg = prePrepareMsg.RequestMsg
 
+	// 批次及其中的每个请求都必须带有主节点分配的序号
+	if prePrepareMsg.RequestMsg.SequenceID != prePrepareMsg.SequenceID {
+		return nil, errors.New("pre-prepare message contains batch with wrong sequence ID")
+	}
+	for _, value := range prePrepareMsg.RequestMsg.Requests {
+		if value == nil || value.SequenceID != prePrepareMsg.SequenceID {
+			return nil, errors.New("pre-prepare message contains request with wrong sequence ID")
+		}
+	}
+
 	// Verify if v, n(a.k.a. sequenceID), d are correct.
 	if !state.verifyMsg(prePrepareMsg.ViewID, prePrepareMsg.SequenceID, prePrepareMsg.Digest) {
 		return nil, errors.New("pre-prepare message is corrupted")
 	}
 
-	// Check
+	state.MsgLogs.PrePrepareMsg = prePrepareMsg
 
 	// Change the stage to pre-prepared.
 	state.CurrentStage = PrePrepared
@@ -119,6 +156,14 @@ func (state *State) Prepare(prepareMsg *VoteMsg) (*VoteMsg, error) {
 		return nil, errors.New("prepare message is corrupted")
 	}
 
+	if prepareMsg.MsgType != PrepareMsg {
+		return nil, fmt.Errorf("vote of type %d is not a prepare", prepareMsg.MsgType)
+	}
+
+	if !state.isMember(prepareMsg.NodeID) {
+		return nil, fmt.Errorf("prepare from non-committee node %s", prepareMsg.NodeID)
+	}
+
 	// Append msg to its logs
 	state.MsgLogs.PrepareMsgs[prepareMsg.NodeID] = prepareMsg
 
@@ -146,6 +191,14 @@ func (state *State) Commit(commitMsg *VoteMsg) (*ReplyMsg, *BatchRequestMsg, err
 		return nil, nil, errors.New("commit message is corrupted")
 	}
 
+	if commitMsg.MsgType != CommitMsg {
+		return nil, nil, fmt.Errorf("vote of type %d is not a commit", commitMsg.MsgType)
+	}
+
+	if !state.isMember(commitMsg.NodeID) {
+		return nil, nil, fmt.Errorf("commit from non-committee node %s", commitMsg.NodeID)
+	}
+
 	// Append msg to its logs
 	state.MsgLogs.CommitMsgs[commitMsg.NodeID] = commitMsg
 
@@ -153,8 +206,8 @@ func (state *State) Commit(commitMsg *VoteMsg) (*ReplyMsg, *BatchRequestMsg, err
 	fmt.Printf("[Commit-Vote]: %d\n", len(state.MsgLogs.CommitMsgs))
 
 	if state.committed() {
-		// This node executes the requested operation locally and gets the result.
-		result := "Executed"
+		// 本地共识只确定请求在本集群内的顺序，请求在全局共识完成后才由状态机执行
+		result := "Committed"
 
 		// Change the stage to prepared.
 		// state.CurrentStage = Committed
@@ -177,13 +230,17 @@ func (state *State) verifyMsg(viewID int64, sequenceID int64, digestGot string)
 		return false
 	}
 
+	// 序号必须位于低水位和高水位之间
+	if state.HighWatermark != 0 && (sequenceID <= state.LowWatermark || sequenceID > state.HighWatermark) {
+		fmt.Printf("watermark error: %d not in (%d, %d]\n", sequenceID, state.LowWatermark, state.HighWatermark)
+		return false
+	}
+
 	// Check if the Primary sent fault sequence number. => Faulty primary.
-	// TODO: adopt upper/lower bound check.
-	if state.LastSequenceID != -1 {
-		if state.LastSequenceID >= sequenceID {
-			fmt.Printf("seqID error\n")
-			return false
-		}
+	// 序号必须紧接在上一个已提交的序号之后，既不能跳号也不能重复
+	if state.LastSequenceID+1 != sequenceID {
+		fmt.Printf("seqID error: expect %d, got %d\n", state.LastSequenceID+1, sequenceID)
+		return false
 	}
 
 	digest, err := digest(state.MsgLogs.ReqMsg)
@@ -200,12 +257,46 @@ func (state *State) verifyMsg(viewID int64, sequenceID int64, digestGot string)
 	return true
 }
 
+// PreparedCert 返回当前请求的 prepared 证明，尚未达到 prepared 状态时返回 nil
+func (state *State) PreparedCert() *PreparedCert {
+	if !state.prepared() || state.MsgLogs.PrePrepareMsg == nil {
+		return nil
+	}
+
+	cert := &PreparedCert{
+		PrePrepareMsg: state.MsgLogs.PrePrepareMsg,
+		PrepareMsgs:   make([]*VoteMsg, 0, len(state.MsgLogs.PrepareMsgs)),
+	}
+	for _, msg := range state.MsgLogs.PrepareMsgs {
+		cert.PrepareMsgs = append(cert.PrepareMsgs, msg)
+	}
+
+	return cert
+}
+
+// CommitCert 返回当前请求的 committed 证明，尚未达到 committed 状态时返回 nil
+func (state *State) CommitCert() *CommitCert {
+	if state.CurrentStage != Committed || state.MsgLogs.PrePrepareMsg == nil {
+		return nil
+	}
+
+	cert := &CommitCert{
+		PrePrepareMsg: state.MsgLogs.PrePrepareMsg,
+		CommitMsgs:    make([]*VoteMsg, 0, len(state.MsgLogs.CommitMsgs)),
+	}
+	for _, msg := range state.MsgLogs.CommitMsgs {
+		cert.CommitMsgs = append(cert.CommitMsgs, msg)
+	}
+
+	return cert
+}
+
 func (state *State) prepared() bool {
 	if state.MsgLogs.ReqMsg == nil {
 		return false
 	}
 
-	if len(state.MsgLogs.PrepareMsgs) < 2*F {
+	if state.votes(state.MsgLogs.PrepareMsgs) < 2*state.faults() {
 		return false
 	}
 
@@ -217,13 +308,37 @@ func (state *State) committed() bool {
 		return false
 	}
 
-	if len(state.MsgLogs.CommitMsgs) < 2*F {
+	// 委员会节点的 CommitMsgs 中包含自己的 commit 投票，观察节点需要收到 2f+1 个委员会节点的投票
+	if state.votes(state.MsgLogs.CommitMsgs) < 2*state.faults()+1 {
 		return false
 	}
 
 	return true
 }
 
+func (state *State) isMember(nodeID string) bool {
+	return len(state.Committee) == 0 || state.Committee[nodeID]
+}
+
+// votes 统计委员会节点的投票数量
+func (state *State) votes(msgs map[string]*VoteMsg) int {
+	count := 0
+	for nodeID := range msgs {
+		if state.isMember(nodeID) {
+			count++
+		}
+	}
+	return count
+}
+
+// faults 委员会可以容忍的拜占庭节点数 f = (n - 1) / 3
+func (state *State) faults() int {
+	if len(state.Committee) == 0 {
+		return F
+	}
+	return (len(state.Committee) - 1) / 3
+}
+
 func digest(object interface{}) (string, error) {
 	msg, err := json.Marshal(object)
 
@@ -233,3 +348,108 @@ func digest(object interface{}) (string, error) {
 
 	return Hash(msg), nil
 }
+
+func (log *GlobalLog) Save(cluster string, viewID int64, msg *BatchRequestMsg) {
+	log.Lock.Lock()
+	defer log.Lock.Unlock()
+	if log.MsgLogs[cluster] == nil {
+		log.MsgLogs[cluster] = make(map[int64]*BatchRequestMsg)
+	}
+	log.MsgLogs[cluster][viewID] = msg
+}
+
+func (log *GlobalLog) Get(cluster string, viewID int64) (*BatchRequestMsg, bool) {
+	log.Lock.RLock()
+	defer log.Lock.RUnlock()
+	msg, ok := log.MsgLogs[cluster][viewID]
+	return msg, ok
+}
+
+// SaveShare 保存其他集群主节点发来的消息，同时保留签名以便转发。同一个批次会由多个接收节点转发，
+// 已经保存过的 (cluster, ViewID) 不会被覆盖，返回 false
+func (log *GlobalLog) SaveShare(msg *GlobalShareMsg) bool {
+	log.Lock.Lock()
+	defer log.Lock.Unlock()
+	if _, ok := log.Shares[msg.Cluster][msg.ViewID]; ok {
+		return false
+	}
+	if log.Shares == nil {
+		log.Shares = make(map[string]map[int64]*GlobalShareMsg)
+	}
+	if log.Shares[msg.Cluster] == nil {
+		log.Shares[msg.Cluster] = make(map[int64]*GlobalShareMsg)
+	}
+	log.Shares[msg.Cluster][msg.ViewID] = msg
+	if log.MsgLogs[msg.Cluster] == nil {
+		log.MsgLogs[msg.Cluster] = make(map[int64]*BatchRequestMsg)
+	}
+	log.MsgLogs[msg.Cluster][msg.ViewID] = msg.RequestMsg
+	return true
+}
+
+// SaveCert 保存本集群在轮次 viewID 提交的批次的 commit 证明
+func (log *GlobalLog) SaveCert(viewID int64, cert *CommitCert) {
+	log.Lock.Lock()
+	defer log.Lock.Unlock()
+	if log.Certs == nil {
+		log.Certs = make(map[int64]*CommitCert)
+	}
+	log.Certs[viewID] = cert
+}
+
+func (log *GlobalLog) GetShare(cluster string, viewID int64) (*GlobalShareMsg, bool) {
+	log.Lock.RLock()
+	defer log.Lock.RUnlock()
+	msg, ok := log.Shares[cluster][viewID]
+	return msg, ok
+}
+
+func (log *GlobalLog) GetCert(viewID int64) (*CommitCert, bool) {
+	log.Lock.RLock()
+	defer log.Lock.RUnlock()
+	cert, ok := log.Certs[viewID]
+	return cert, ok
+}
+
+// SharesFrom 返回其他集群轮次不小于 viewID 的消息
+func (log *GlobalLog) SharesFrom(viewID int64) []*GlobalShareMsg {
+	log.Lock.RLock()
+	defer log.Lock.RUnlock()
+	msgs := make([]*GlobalShareMsg, 0)
+	for _, shares := range log.Shares {
+		for id, msg := range shares {
+			if id >= viewID {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	return msgs
+}
+
+// Truncate 删除所有集群中轮次小于 viewID 的消息，返回删除的条数
+func (log *GlobalLog) Truncate(viewID int64) int {
+	log.Lock.Lock()
+	defer log.Lock.Unlock()
+	deleted := 0
+	for _, msgs := range log.MsgLogs {
+		for id := range msgs {
+			if id < viewID {
+				delete(msgs, id)
+				deleted++
+			}
+		}
+	}
+	for _, shares := range log.Shares {
+		for id := range shares {
+			if id < viewID {
+				delete(shares, id)
+			}
+		}
+	}
+	for id := range log.Certs {
+		if id < viewID {
+			delete(log.Certs, id)
+		}
+	}
+	return deleted
+}
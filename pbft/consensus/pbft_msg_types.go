@@ -9,9 +9,23 @@ type RequestMsg struct {
 }
 
 type BatchRequestMsg struct {
-	Requests  [BatchSize]*RequestMsg `json:"Requests"`
+	Requests  []*RequestMsg          `json:"Requests"` // 最多 MaxBatchSize 个请求
 	Timestamp int64                  `json:"timestamp"`
 	ClientID  string                 `json:"clientID"`
+	Reports   []*ParticipationReport `json:"reports,omitempty"` // 主节点附加的之前序号的参与报告，执行时用于更新信誉分数
+	// 主节点分配的序号，计入摘要，不包含请求的空批次据此区分不同的轮次
+	SequenceID int64 `json:"sequenceID,omitempty"`
+}
+
+// ParticipationReport 本集群序号 SequenceID 的 commit 证明，其中每条 commit 投票列出了该节点收到的 prepare 消息的发送者
+type ParticipationReport struct {
+	SequenceID int64      `json:"sequenceID"`
+	ViewID     int64      `json:"viewID"`
+	ViewNumber int64      `json:"viewNumber"`
+	Digest     string     `json:"digest"`
+	CommitMsgs []*VoteMsg `json:"commitMsgs"`
+	// 观察节点发给主节点的 commit，不计入法定人数，只证明观察节点在线
+	ObserverMsgs []*VoteMsg `json:"observerMsgs,omitempty"`
 }
 
 type ReplyMsg struct {
@@ -20,10 +34,12 @@ type ReplyMsg struct {
 	ClientID  string `json:"clientID"`
 	NodeID    string `json:"nodeID"`
 	Result    string `json:"result"`
+	Primary   string `json:"primary,omitempty"` // 回复时集群的主节点，客户端据此发送之后的请求
 }
 
 type PrePrepareMsg struct {
 	ViewID     int64            `json:"viewID"`
+	ViewNumber int64            `json:"viewNumber"` // PBFT 视图编号，决定当前主节点
 	SequenceID int64            `json:"sequenceID"`
 	Digest     string           `json:"digest"`
 	NodeID     string           `json:"nodeID"` //添加nodeID
@@ -33,11 +49,14 @@ type PrePrepareMsg struct {
 
 type VoteMsg struct {
 	ViewID     int64  `json:"viewID"`
+	ViewNumber int64  `json:"viewNumber"`
 	SequenceID int64  `json:"sequenceID"`
 	Digest     string `json:"digest"`
 	NodeID     string `json:"nodeID"`
 	MsgType    `json:"msgType"`
 	Sign       []byte `json:"sign"` // 如果你想在 JSON 中包含 Sign 字段
+	// commit 消息中列出该节点进入 prepared 时收到的 prepare 消息的发送者
+	PrepareSenders []string `json:"prepareSenders,omitempty"`
 }
 
 type GlobalShareMsg struct {
@@ -47,6 +66,8 @@ type GlobalShareMsg struct {
 	Digest     string           `json:"digest"`
 	Sign       []byte           `json:"sign"` // 如果你想在 JSON 中包含 Sign 字段
 	ViewID     int64            `json:"viewID"`
+	ViewNumber int64            `json:"viewNumber"` // 发送时所在集群的视图编号，用于确认发送者是否为主节点
+	CommitMsgs []*VoteMsg       `json:"commitMsgs"` // 发送集群 2f+1 个节点的 commit 投票，证明批次确实在该集群达成了本地共识
 }
 
 type LocalMsg struct {
@@ -55,7 +76,111 @@ type LocalMsg struct {
 	Sign           []byte          `json:"sign"` // 如果你想在 JSON 中包含 Sign 字段
 }
 
-const BatchSize = 1
+// CheckpointMsg 节点每执行完 CheckpointPeriod 个全局轮次后广播，Digest 为此时状态快照的摘要
+type CheckpointMsg struct {
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	Cluster    string `json:"ClusterName"`
+	NodeID     string `json:"nodeID"`
+	Sign       []byte `json:"sign"`
+}
+
+// Checkpoint 稳定检查点，Proof 中包含 2f+1 个节点对同一序号和摘要的签名
+type Checkpoint struct {
+	SequenceID int64            `json:"sequenceID"`
+	Digest     string           `json:"digest"`
+	Proof      []*CheckpointMsg `json:"proof"`
+}
+
+// PreparedCert 是某个请求在本地达到 prepared 状态的证明：pre-prepare 消息加上 2f 条 prepare 投票
+type PreparedCert struct {
+	PrePrepareMsg *PrePrepareMsg `json:"prePrepareMsg"`
+	PrepareMsgs   []*VoteMsg     `json:"prepareMsgs"`
+}
+
+// ViewChangeMsg 备份节点的请求计时器超时后广播，请求切换到视图 NewView
+type ViewChangeMsg struct {
+	NewView       int64           `json:"newView"`
+	View          int64           `json:"view"`       // 发送者当前所处的视图，其委员会中的 2f+1 个节点才能完成切换
+	ViewID        int64           `json:"viewID"`     // 发送者当前所处的本地共识轮次
+	Checkpoint    *Checkpoint     `json:"checkpoint"` // 发送者的最新稳定检查点
+	PreparedCerts []*PreparedCert `json:"preparedCerts"`
+	Cluster       string          `json:"ClusterName"`
+	NodeID        string          `json:"nodeID"`
+	Digest        string          `json:"digest"`
+	Sign          []byte          `json:"sign"`
+}
+
+// NewViewMsg 新主节点收集到 2f+1 条 ViewChangeMsg 后广播，
+// PrePrepareMsgs 中是新视图下重新提出的已 prepared 请求
+type NewViewMsg struct {
+	NewView        int64            `json:"newView"`
+	ViewChangeMsgs []*ViewChangeMsg `json:"viewChangeMsgs"`
+	PrePrepareMsgs []*PrePrepareMsg `json:"prePrepareMsgs"`
+	NodeID         string           `json:"nodeID"`
+	Digest         string           `json:"digest"`
+	Sign           []byte           `json:"sign"`
+}
+
+// RemoteViewChangeMsg 等待全局轮次 ViewID 超时的节点先在本集群广播，本集群 2f+1 个节点达成一致后发给 TargetCluster 的所有节点，
+// 请求替换其视图 ViewNumber 下不发送批次的主节点
+type RemoteViewChangeMsg struct {
+	TargetCluster string `json:"targetCluster"`
+	ViewID        int64  `json:"viewID"`     // 等待的全局轮次
+	ViewNumber    int64  `json:"viewNumber"` // 要替换的目标集群视图
+	Cluster       string `json:"ClusterName"`
+	NodeID        string `json:"nodeID"`
+	Digest        string `json:"digest"`
+	Sign          []byte `json:"sign"`
+}
+
+// PrimaryChangeMsg 选举出的主节点进入新纪元的第一个视图后通知其他集群，
+// 其他集群据此更新记录的视图编号，之后只接受新主节点发送的全局共享消息
+type PrimaryChangeMsg struct {
+	Cluster    string `json:"ClusterName"`
+	ViewNumber int64  `json:"viewNumber"`
+	NodeID     string `json:"nodeID"`
+	Digest     string `json:"digest"`
+	Sign       []byte `json:"sign"`
+}
+
+// CommitCert 是某个批次在本地达到 committed 状态的证明：pre-prepare 消息加上 2f+1 条 commit 投票
+type CommitCert struct {
+	PrePrepareMsg *PrePrepareMsg `json:"prePrepareMsg"`
+	CommitMsgs    []*VoteMsg     `json:"commitMsgs"`
+}
+
+// Snapshot 执行完序号 SequenceID 对应的全局轮次后的状态，检查点的摘要即快照的摘要
+type Snapshot struct {
+	SequenceID  int64  `json:"sequenceID"`
+	ViewID      int64  `json:"viewID"` // 快照之后下一个要执行的全局轮次
+	StateDigest string `json:"stateDigest"`
+	BlockHash   string `json:"blockHash"` // 序号 SequenceID 对应区块的哈希，之后的区块从这里继续链接
+	App         []byte `json:"app"`       // 状态机快照
+	Clients     []byte `json:"clients"`   // 客户端回复缓存
+	Executed    int    `json:"executed"`  // 已执行的请求数量
+	Scores      []byte `json:"scores"`    // 信誉分数
+}
+
+// FetchStateMsg 落后的节点向本集群其他节点请求缺失的状态
+type FetchStateMsg struct {
+	SequenceID int64  `json:"sequenceID"` // 请求者最近一次完成本地共识的序号
+	ViewID     int64  `json:"viewID"`     // 请求者下一个要执行的全局轮次
+	ViewNumber int64  `json:"viewNumber"`
+	Cluster    string `json:"ClusterName"`
+	NodeID     string `json:"nodeID"`
+}
+
+// StateTransferMsg 回复 FetchStateMsg，其中每一部分都带有可以单独验证的签名证明
+type StateTransferMsg struct {
+	Checkpoint      *Checkpoint       `json:"checkpoint"` // 快照对应的稳定检查点
+	Snapshot        *Snapshot         `json:"snapshot"`   // 请求者还没有执行到稳定检查点时才发送
+	CommitCerts     []*CommitCert     `json:"commitCerts"`
+	GlobalShareMsgs []*GlobalShareMsg `json:"globalShareMsgs"` // 其他集群主节点签名的批次
+	NewViewMsg      *NewViewMsg       `json:"newViewMsg"`      // 请求者的视图落后时附上最新的 NEW-VIEW
+	Cluster         string            `json:"ClusterName"`
+	NodeID          string            `json:"nodeID"`
+}
 
 type MsgType int
 
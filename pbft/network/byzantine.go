@@ -0,0 +1,271 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behaviour 恶意节点在发送消息时表现出的一种拜占庭行为，一个节点可以同时启用多种行为
+type Behaviour string
+
+const (
+	ZeroSequence     Behaviour = "zero-sequence"     // prepare 和 commit 的序号置为 0，即原来的恶意节点
+	Equivocate       Behaviour = "equivocate"        // 主节点给编号为奇数的备份节点发送同一序号的另一个(空)批次
+	WrongDigest      Behaviour = "wrong-digest"      // pre-prepare、投票和 CHECKPOINT 携带错误的摘要
+	ForgeSign        Behaviour = "forge-sign"        // 用随机字节代替签名
+	WithholdVotes    Behaviour = "withhold"          // 不发送 prepare、commit 和 CHECKPOINT
+	DelayMessages    Behaviour = "delay"             // 所有消息延迟 ByzantineDelay 后发送
+	ReplayOldView    Behaviour = "replay-view"       // 进入新视图后继续重放旧视图中发送过的共识消息
+	ConflictingShare Behaviour = "conflicting-share" // 主节点给一半的集群及接收节点发送另一个批次的 GlobalShareMsg
+)
+
+var allBehaviours = []Behaviour{ZeroSequence, Equivocate, WrongDigest, ForgeSign, WithholdVotes, DelayMessages, ReplayOldView, ConflictingShare}
+
+// ByzantineDelay 启用 delay 行为时每条消息的延迟
+var ByzantineDelay = 2 * time.Second
+
+// Byzantine 本节点启用的拜占庭行为，没有启用任何行为时为正常节点
+type Byzantine struct {
+	Behaviours map[Behaviour]bool
+	replayed   map[string]*sentMsg // path - 最早发送的共识消息，进入新视图后重放
+	Lock       sync.Mutex
+}
+
+type sentMsg struct {
+	ViewNumber int64
+	Msg        interface{}
+}
+
+// ParseBehaviours 解析以逗号分隔的行为列表。"No" 或空字符串表示正常节点，
+// 为兼容原来的命令行参数，"Yes" 表示 zero-sequence
+func ParseBehaviours(spec string) (*Byzantine, error) {
+	byzantine := &Byzantine{
+		Behaviours: make(map[Behaviour]bool),
+		replayed:   make(map[string]*sentMsg),
+	}
+	if spec == "" || spec == "No" {
+		return byzantine, nil
+	}
+	if spec == "Yes" {
+		byzantine.Behaviours[ZeroSequence] = true
+		return byzantine, nil
+	}
+	for _, name := range strings.Split(spec, ",") {
+		behaviour := Behaviour(strings.TrimSpace(name))
+		known := false
+		for _, b := range allBehaviours {
+			known = known || b == behaviour
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown byzantine behaviour %q, expect one of %v", behaviour, allBehaviours)
+		}
+		byzantine.Behaviours[behaviour] = true
+	}
+	return byzantine, nil
+}
+
+// Has 判断是否启用了行为 behaviour
+func (byzantine *Byzantine) Has(behaviour Behaviour) bool {
+	return byzantine != nil && byzantine.Behaviours[behaviour]
+}
+
+// IsMalicious 判断是否启用了任何拜占庭行为
+func (byzantine *Byzantine) IsMalicious() bool {
+	return byzantine != nil && len(byzantine.Behaviours) > 0
+}
+
+// String 按名称排列启用的行为
+func (byzantine *Byzantine) String() string {
+	names := make([]string, 0, len(byzantine.Behaviours))
+	for behaviour := range byzantine.Behaviours {
+		names = append(names, string(behaviour))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// byzantineMsgs 返回发给集群 cluster 的节点 nodeID 的消息。正常节点原样返回 msg；
+// 恶意节点返回按启用的行为篡改后的副本，可能为空(扣留)或者在前面加上重放的旧消息。msg 本身不会被修改
+func (node *Node) byzantineMsgs(cluster string, nodeID string, msg interface{}, path string) []interface{} {
+	byzantine := node.Byzantine
+	if !byzantine.IsMalicious() {
+		return []interface{}{msg}
+	}
+	msgs := make([]interface{}, 0, 2)
+	if byzantine.Has(ReplayOldView) {
+		if old := node.replayMsg(msg, path); old != nil {
+			msgs = append(msgs, old)
+		}
+	}
+
+	odd := nodeIndex(cluster, nodeID)%2 == 1
+	switch m := msg.(type) {
+	case *consensus.PrePrepareMsg:
+		tampered := *m
+		if byzantine.Has(Equivocate) && path == "/preprepare" && odd {
+			tampered = *node.equivocation(m)
+		}
+		if byzantine.Has(WrongDigest) {
+			tampered.Digest = wrongDigest(tampered.Digest)
+		}
+		if byzantine.Has(ForgeSign) {
+			tampered.Sign = forgedSign(tampered.Sign)
+		}
+		msg = &tampered
+	case *consensus.VoteMsg:
+		if byzantine.Has(WithholdVotes) {
+			return msgs
+		}
+		tampered := *m
+		if byzantine.Has(ZeroSequence) {
+			tampered.SequenceID = 0
+		}
+		if byzantine.Has(WrongDigest) {
+			tampered.Digest = wrongDigest(tampered.Digest)
+		}
+		if byzantine.Has(ForgeSign) {
+			tampered.Sign = forgedSign(tampered.Sign)
+		}
+		msg = &tampered
+	case *consensus.CheckpointMsg:
+		if byzantine.Has(WithholdVotes) {
+			return msgs
+		}
+		tampered := *m
+		if byzantine.Has(WrongDigest) {
+			tampered.Digest = wrongDigest(tampered.Digest)
+		}
+		if byzantine.Has(ForgeSign) {
+			tampered.Sign = forgedSign(tampered.Sign)
+		}
+		msg = &tampered
+	case *consensus.GlobalShareMsg:
+		tampered := *m
+		// 集群位置与节点编号之和为奇数的接收节点收到另一个批次，只有两个集群时同一集群的接收节点也会收到不同的批次
+		if byzantine.Has(ConflictingShare) && (clusterIndex(cluster)+nodeIndex(cluster, nodeID))%2 == 1 {
+			tampered = *node.conflictingShare(m)
+		}
+		if byzantine.Has(ForgeSign) {
+			tampered.Sign = forgedSign(tampered.Sign)
+		}
+		msg = &tampered
+	case *consensus.ViewChangeMsg:
+		tampered := *m
+		if byzantine.Has(ForgeSign) {
+			tampered.Sign = forgedSign(tampered.Sign)
+		}
+		msg = &tampered
+	case *consensus.NewViewMsg:
+		tampered := *m
+		if byzantine.Has(ForgeSign) {
+			tampered.Sign = forgedSign(tampered.Sign)
+		}
+		msg = &tampered
+	}
+	return append(msgs, msg)
+}
+
+// deliver 发送已经序列化的消息，启用 delay 行为时在后台延迟发送
+func (node *Node) deliver(url string, jsonMsg []byte) {
+	if node.Byzantine.Has(DelayMessages) {
+		go func() {
+			time.Sleep(ByzantineDelay)
+			send(url, jsonMsg)
+		}()
+		return
+	}
+	send(url, jsonMsg)
+}
+
+// replayMsg 记录每种共识消息第一次发送时的内容，本节点进入更高的视图后返回这条旧消息用于重放
+func (node *Node) replayMsg(msg interface{}, path string) interface{} {
+	var viewNumber int64
+	switch m := msg.(type) {
+	case *consensus.PrePrepareMsg:
+		viewNumber = m.ViewNumber
+	case *consensus.VoteMsg:
+		viewNumber = m.ViewNumber
+	default:
+		return nil
+	}
+
+	byzantine := node.Byzantine
+	byzantine.Lock.Lock()
+	defer byzantine.Lock.Unlock()
+	old, ok := byzantine.replayed[path]
+	if !ok {
+		byzantine.replayed[path] = &sentMsg{ViewNumber: viewNumber, Msg: msg}
+		return nil
+	}
+	if old.ViewNumber >= viewNumber {
+		return nil
+	}
+	return old.Msg
+}
+
+// equivocation 为 pre-prepare 中的序号构造另一个由本节点签名的空批次，与原批次摘要不同
+func (node *Node) equivocation(msg *consensus.PrePrepareMsg) *consensus.PrePrepareMsg {
+	other := nullPrePrepare(msg.SequenceID)
+	other.RequestMsg.Timestamp = time.Now().UnixNano()
+	jsonMsg, _ := json.Marshal(other.RequestMsg)
+	other.Digest = consensus.Hash(jsonMsg)
+	other.ViewNumber = msg.ViewNumber
+	other.NodeID = msg.NodeID
+	digestByte, _ := hex.DecodeString(other.Digest)
+	other.Sign = node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
+	return other
+}
+
+// conflictingShare 构造同一轮次的另一个由本节点签名的空批次，commit 投票仍然是原批次的
+func (node *Node) conflictingShare(msg *consensus.GlobalShareMsg) *consensus.GlobalShareMsg {
+	other := *msg
+	other.RequestMsg = &consensus.BatchRequestMsg{
+		Requests:  make([]*consensus.RequestMsg, 0),
+		Timestamp: time.Now().UnixNano(),
+		ClientID:  msg.RequestMsg.ClientID,
+
+		SequenceID: msg.RequestMsg.SequenceID,
+	}
+	jsonMsg, _ := json.Marshal(other.RequestMsg)
+	other.Digest = consensus.Hash(jsonMsg)
+	digestByte, _ := hex.DecodeString(other.Digest)
+	other.Sign = node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
+	return &other
+}
+
+func wrongDigest(digest string) string {
+	return consensus.Hash([]byte("wrong-" + digest))
+}
+
+func forgedSign(sign []byte) []byte {
+	forged := make([]byte, len(sign))
+	if len(forged) == 0 {
+		forged = make([]byte, 256)
+	}
+	rand.Read(forged)
+	return forged
+}
+
+// nodeIndex 返回节点编号，即去掉集群名称后的数字
+func nodeIndex(cluster string, nodeID string) int {
+	index, _ := strconv.Atoi(strings.TrimPrefix(nodeID, cluster))
+	return index
+}
+
+// clusterIndex 返回集群在 Allcluster 中的位置，用于区分收到冲突消息的集群
+func clusterIndex(cluster string) int {
+	for i := 0; i < ClusterNumber; i++ {
+		if Allcluster[i] == cluster {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,225 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+)
+
+// saveCommittedDigest 将全局执行的批次按执行顺序并入状态摘要，状态摘要是快照的一部分
+func (node *Node) saveCommittedDigest(committedMsg *consensus.BatchRequestMsg) {
+	msg, err := json.Marshal(committedMsg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	node.StateDigest = consensus.Hash([]byte(node.StateDigest + consensus.Hash(msg)))
+}
+
+// inWatermarks 序号是否位于 (h, h + WatermarkWindow] 之间，主节点不会提出超过高水位的请求
+func (node *Node) inWatermarks(sequenceID int64) bool {
+	low := node.StableCheckpoint.SequenceID
+	return sequenceID > low && sequenceID <= low+consensus.WatermarkWindow
+}
+
+// takeSnapshot 执行完序号 sequenceID 对应的全局轮次后保存状态快照，调用时需持有 GlobalViewIDLock
+func (node *Node) takeSnapshot(sequenceID int64) {
+	appState, err := node.App.Snapshot()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	clients, err := node.ClientTable.Snapshot()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	scores, err := node.Reputation.Snapshot()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	node.Snapshots[sequenceID] = &consensus.Snapshot{
+		SequenceID:  sequenceID,
+		ViewID:      node.GlobalViewID,
+		StateDigest: node.StateDigest,
+		BlockHash:   node.BlockHash,
+		App:         appState,
+		Clients:     clients,
+		Executed:    node.CommittedBase + len(node.CommittedMsgs),
+		Scores:      scores,
+	}
+}
+
+// SendCheckpoint 执行完序号 sequenceID 对应的全局轮次后向本集群广播 CHECKPOINT 消息，观察节点不发送，调用时需持有 GlobalViewIDLock
+func (node *Node) SendCheckpoint(sequenceID int64) {
+	snapshot, ok := node.Snapshots[sequenceID]
+	if !ok || node.isObserver() {
+		return
+	}
+	checkpointMsg := &consensus.CheckpointMsg{
+		SequenceID: sequenceID,
+		Digest:     snapshotDigest(snapshot),
+		Cluster:    node.ClusterName,
+		NodeID:     node.NodeID,
+	}
+	_, checkpointMsg.Sign = node.signMsg(checkpointMsg)
+
+	LogStage(fmt.Sprintf("Checkpoint (SequenceID:%d)", sequenceID), false)
+	node.Broadcast(node.ClusterName, checkpointMsg, "/checkpoint")
+	// 自己的 CHECKPOINT 同样交给 resolveMsg 处理
+	node.MsgBufferLock.CheckpointMsgsLock.Lock()
+	node.MsgBuffer.CheckpointMsgs = append(node.MsgBuffer.CheckpointMsgs, checkpointMsg)
+	node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+}
+
+// GetCheckpoint 收集 CHECKPOINT 消息，同一序号和摘要收到当前委员会 2f+1 个成员的消息后成为稳定检查点
+func (node *Node) GetCheckpoint(msg *consensus.CheckpointMsg) error {
+	if msg.SequenceID <= node.StableCheckpoint.SequenceID {
+		return nil
+	}
+	if msg.Cluster != node.ClusterName {
+		return fmt.Errorf("checkpoint from other cluster %s", msg.Cluster)
+	}
+	if err := node.verifyMsgSign(msg.NodeID, checkpointDigest(msg), msg.Sign, checkpointDigest(msg)); err != nil {
+		return err
+	}
+
+	if node.CheckpointMsgs[msg.SequenceID] == nil {
+		node.CheckpointMsgs[msg.SequenceID] = make(map[string]*consensus.CheckpointMsg)
+	}
+	node.CheckpointMsgs[msg.SequenceID][msg.NodeID] = msg
+
+	proof := make([]*consensus.CheckpointMsg, 0)
+	for _, checkpointMsg := range node.CheckpointMsgs[msg.SequenceID] {
+		// 观察节点和委员会之外的节点不计入法定人数
+		if checkpointMsg.Digest == msg.Digest && node.inCommittee(node.ClusterName, node.View.Number, checkpointMsg.NodeID) {
+			proof = append(proof, checkpointMsg)
+		}
+	}
+	fmt.Printf("[Checkpoint-Vote]: SequenceID %d, %d\n", msg.SequenceID, len(proof))
+	if len(proof) < 2*clusterF(node.ClusterName)+1 {
+		return nil
+	}
+
+	checkpoint := &consensus.Checkpoint{
+		SequenceID: msg.SequenceID,
+		Digest:     msg.Digest,
+		Proof:      proof,
+	}
+	node.WAL.Append(walCheckpoint, checkpoint)
+
+	node.GlobalViewIDLock.Lock()
+	node.StableCheckpoint = checkpoint
+	node.truncateGlobalLog()
+	node.compactWAL(checkpoint)
+	node.GlobalViewIDLock.Unlock()
+
+	node.collectGarbage()
+	LogStage(fmt.Sprintf("Checkpoint (SequenceID:%d)", msg.SequenceID), true)
+	return nil
+}
+
+// verifyCheckpoint 稳定检查点需要当前委员会中 2f+1 个不同成员对同一序号和摘要的有效签名
+func (node *Node) verifyCheckpoint(checkpoint *consensus.Checkpoint) error {
+	signers := make(map[string]bool)
+	for _, msg := range checkpoint.Proof {
+		if msg.SequenceID != checkpoint.SequenceID || msg.Digest != checkpoint.Digest || msg.Cluster != node.ClusterName {
+			continue
+		}
+		if !node.inCommittee(node.ClusterName, node.View.Number, msg.NodeID) {
+			continue
+		}
+		if err := node.verifyMsgSign(msg.NodeID, checkpointDigest(msg), msg.Sign, checkpointDigest(msg)); err != nil {
+			continue
+		}
+		signers[msg.NodeID] = true
+	}
+	if len(signers) < 2*clusterF(node.ClusterName)+1 {
+		return errors.New("checkpoint proof does not contain 2f+1 valid signatures")
+	}
+	return nil
+}
+
+// collectGarbage 删除稳定检查点之前的本地消息日志
+func (node *Node) collectGarbage() {
+	stable := node.StableCheckpoint.SequenceID
+
+	for sequenceID := range node.CheckpointMsgs {
+		if sequenceID <= stable {
+			delete(node.CheckpointMsgs, sequenceID)
+		}
+	}
+	for sequenceID := range node.MsgBuffer.BatchReqMsgs {
+		if sequenceID <= stable {
+			delete(node.MsgBuffer.BatchReqMsgs, sequenceID)
+		}
+	}
+	node.StatesLock.Lock()
+	for sequenceID, state := range node.States {
+		if sequenceID <= stable && state.CurrentStage == consensus.Committed {
+			delete(node.States, sequenceID)
+		}
+	}
+	node.StatesLock.Unlock()
+	for sequenceID := range node.AcceptRequestTime {
+		if sequenceID <= stable {
+			delete(node.AcceptRequestTime, sequenceID)
+		}
+	}
+}
+
+// truncateGlobalLog 删除已执行且低于稳定检查点的全局日志和已提交请求，调用时需持有 GlobalViewIDLock
+func (node *Node) truncateGlobalLog() {
+	low := viewIDOfSequence(node.StableCheckpoint.SequenceID)
+	if node.GlobalViewID <= low {
+		low = node.GlobalViewID - 1
+	}
+	if deleted := node.GlobalLog.Truncate(low); deleted > 0 {
+		fmt.Printf("截断全局日志 %d 条, 低于 ViewID %d\n", deleted, low)
+	}
+	// 只保留稳定检查点及之后的快照
+	for sequenceID := range node.Snapshots {
+		if sequenceID < node.StableCheckpoint.SequenceID {
+			delete(node.Snapshots, sequenceID)
+		}
+	}
+
+	// CommittedMsgs 中只保留轮次不低于 low 的请求
+	keep := 0
+	for viewID := low; viewID < node.GlobalViewID; viewID++ {
+		for i := 0; i < ClusterNumber; i++ {
+			if msg, ok := node.GlobalLog.Get(Allcluster[i], viewID); ok {
+				keep += len(msg.Requests)
+			}
+		}
+	}
+	if drop := len(node.CommittedMsgs) - keep; drop > 0 {
+		node.CommittedMsgs = append([]*consensus.RequestMsg(nil), node.CommittedMsgs[drop:]...)
+		node.CommittedBase += drop
+	}
+}
+
+func checkpointDigest(msg *consensus.CheckpointMsg) string {
+	unsigned := *msg
+	unsigned.Sign = nil
+	jsonMsg, _ := json.Marshal(&unsigned)
+	return consensus.Hash(jsonMsg)
+}
+
+func snapshotDigest(snapshot *consensus.Snapshot) string {
+	jsonMsg, _ := json.Marshal(snapshot)
+	return consensus.Hash(jsonMsg)
+}
+
+// sequenceOfViewID 全局轮次 viewID 对应的本地序号，是 viewIDOfSequence 的逆
+func sequenceOfViewID(viewID int64) int64 {
+	return viewID - viewIDOfSequence(1) + 1
+}
+
+// viewIDOfSequence 每一轮本地共识恰好提交一个序号，序号 n 对应的全局轮次为 viewID + n - 1
+func viewIDOfSequence(sequenceID int64) int64 {
+	const viewID = 10000000000 // temporary.
+	return viewID + sequenceID - 1
+}
@@ -1,20 +1,15 @@
 package network
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"simple_pbft/pbft/consensus"
+	"simple_pbft/pbft/client"
 	"strconv"
 	"time"
 )
 
-type reply struct {
-	msg       consensus.RequestMsg
-	startTime time.Time
-}
-
 var ClientURL = map[string]string{
 	"N": "127.0.0.1:5000",
 	"M": "127.0.0.1:5001",
@@ -28,55 +23,60 @@ type Client struct {
 	url           string
 	cluster       string
 	NodeTable     map[string]map[string]string // key=nodeID, value=url
-	msgTimeLog    map[int64]reply
 	sendMsgNumber int
+	// 负责发送请求并等待 f+1 个相同的 reply
+	submitter *client.Client
 }
 
 func NewClient(clusterName string) *Client {
-	client := &Client{
-		ClientID:   "Client-" + clusterName,
-		url:        ClientURL[clusterName],
-		cluster:    clusterName,
-		msgTimeLog: make(map[int64]reply),
+	c := &Client{
+		ClientID:  "Client-" + clusterName,
+		url:       ClientURL[clusterName],
+		cluster:   clusterName,
+		NodeTable: loadNodeTable(),
 	}
-	return client
+	c.submitter = client.NewClient(c.ClientID, clusterName, c.url, c.NodeTable, clusterF(clusterName))
+	c.submitter.ErrorLog = log.New(os.Stdout, "", 0)
+	return c
 }
 
 func (client *Client) SendMsg(sendMsgNumber int) error {
-	client.NodeTable = LoadNodeTable("nodetable.txt")
 	client.sendMsgNumber = sendMsgNumber
-	primary := client.cluster + "0"
-	url := client.NodeTable[client.cluster][primary]
-	msg := consensus.RequestMsg{
-		ClientID:  client.ClientID,
-		Timestamp: time.Now().UnixNano(),
-	}
 	for i := 0; i < sendMsgNumber; i++ {
-		Timestamp := time.Now().UnixNano()
-		if Timestamp <= msg.Timestamp {
-			Timestamp++
+		operation := client.operation(i)
+		startTime := time.Now()
+		timestamp, err := client.submitter.Send(operation)
+		if timestamp == 0 {
+			return err
 		}
-		msg.Timestamp = Timestamp
-		msg.Operation = "msg: " + client.ClientID + strconv.Itoa(i)
-		jsonMsg, err := json.Marshal(msg)
 		if err != nil {
-			return err
+			fmt.Println(err)
 		}
+		fmt.Printf("Client Send request: %s\n", operation)
 
-		fmt.Printf("Client Send request Size of JSON message: %d bytes\n", len(jsonMsg))
-		send(url+"/req", jsonMsg)
-		client.msgTimeLog[msg.Timestamp] = reply{
-			msg:       msg,
-			startTime: time.Now(),
-		}
+		go client.GetReply(i, operation, timestamp, startTime)
 	}
 	return nil
 }
 
-func (client *Client) GetReply(msg consensus.ReplyMsg) {
-	duration := time.Since(client.msgTimeLog[msg.Timestamp].startTime)
-	cmd := "msg: Client-" + client.cluster + strconv.Itoa(client.sendMsgNumber-1)
-	if client.msgTimeLog[msg.Timestamp].msg.Operation == cmd {
+// operation 生成第 i 条请求的键值命令，先写入一个键再读取它
+func (client *Client) operation(i int) string {
+	key := client.ClientID + "-" + strconv.Itoa(i/2)
+	if i%2 == 1 {
+		return "GET " + key
+	}
+	return "PUT " + key + " " + strconv.Itoa(i)
+}
+
+// GetReply 等待第 i 条请求收到 f+1 个相同的结果并记录耗时
+func (client *Client) GetReply(i int, operation string, timestamp int64, startTime time.Time) {
+	result, err := client.submitter.Wait(context.Background(), timestamp)
+	if err != nil {
+		fmt.Printf("msg %s failed: %s\n", operation, err)
+		return
+	}
+	duration := time.Since(startTime)
+	if i == client.sendMsgNumber-1 {
 		fmt.Println("save Time!!!")
 		// 创建文件并写入 duration
 		file, err := os.Create("costTime.txt")
@@ -92,5 +92,5 @@ func (client *Client) GetReply(msg consensus.ReplyMsg) {
 		}
 
 	}
-	fmt.Printf("msg %s took %s\n", client.msgTimeLog[msg.Timestamp].msg.Operation, duration)
+	fmt.Printf("msg %s took %s, result: %s\n", operation, duration, result)
 }
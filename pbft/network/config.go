@@ -0,0 +1,255 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"simple_pbft/pbft/consensus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config 集群拓扑和运行参数，节点、客户端和账本校验从同一个 JSON 文件加载，
+// 未填写的参数保持默认值
+type Config struct {
+	KeysDir                   string           `json:"keysDir"` // 默认为 Keys
+	LedgerDir                 string           `json:"ledgerDir"`
+	WALDir                    string           `json:"walDir"`
+	MaxBatchSize              int              `json:"maxBatchSize"`
+	MaxBatchDelayMs           int              `json:"maxBatchDelayMs"`
+	ViewChangeTimeoutMs       int              `json:"viewChangeTimeoutMs"`
+	RemoteViewChangeTimeoutMs int              `json:"remoteViewChangeTimeoutMs"` // 默认为视图切换超时的两倍
+	RotateShareReceivers      *bool            `json:"rotateShareReceivers"`
+	EpochLength               int64            `json:"epochLength"`      // 每个选举纪元包含的全局轮次数
+	ByzantineDelayMs          int              `json:"byzantineDelayMs"` // 启用 delay 行为的节点的消息延迟
+	Clusters                  []*ClusterConfig `json:"clusters"`
+}
+
+// ClusterConfig 一个集群的节点和容错数 f，集群至少需要 3f+1 个节点
+type ClusterConfig struct {
+	Name      string        `json:"name"`
+	F         int           `json:"f"`
+	ClientURL string        `json:"clientURL"`
+	Nodes     []*NodeConfig `json:"nodes"`
+}
+
+// NodeConfig 一个节点的地址和密钥文件，密钥文件为空时使用 KeysDir 下的默认位置
+type NodeConfig struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+	Malicious  bool   `json:"malicious"`
+	// 启用的拜占庭行为，见 Behaviour。只设置 malicious 时为 zero-sequence
+	Behaviours []string `json:"behaviours"`
+}
+
+// ByzantineSpec 返回节点启用的拜占庭行为列表，正常节点为 "No"
+func (node *NodeConfig) ByzantineSpec() string {
+	if len(node.Behaviours) > 0 {
+		return strings.Join(node.Behaviours, ",")
+	}
+	if node.Malicious {
+		return "Yes"
+	}
+	return "No"
+}
+
+// KeysDir 节点公私钥所在的目录，每个节点的密钥位于 KeysDir/cluster/nodeID 下
+var KeysDir = "Keys"
+
+// ClusterF 每个集群的容错数，没有配置的集群使用 consensus.F
+var ClusterF = make(map[string]int)
+
+// loadedConfig 通过 LoadConfig 加载的配置，为空时使用 nodetable.txt 和内置的默认值
+var loadedConfig *Config
+
+// LoadConfig 读取并校验配置文件，未知字段和不合法的取值都会返回错误
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := new(Config)
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Validate 检查集群拓扑和参数。主节点和全局共享的接收节点由编号推算，
+// 因此集群中的节点必须依次命名为 cluster0, cluster1, ...
+func (config *Config) Validate() error {
+	if len(config.Clusters) == 0 {
+		return fmt.Errorf("no cluster is configured")
+	}
+	if config.MaxBatchSize < 0 || config.MaxBatchDelayMs < 0 || config.ViewChangeTimeoutMs < 0 || config.RemoteViewChangeTimeoutMs < 0 || config.EpochLength < 0 || config.ByzantineDelayMs < 0 {
+		return fmt.Errorf("batch, timeout and epoch parameters must not be negative")
+	}
+	clusters := make(map[string]bool)
+	urls := make(map[string]string)
+	for i, cluster := range config.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("cluster %d has no name", i)
+		}
+		if clusters[cluster.Name] {
+			return fmt.Errorf("cluster %s is configured twice", cluster.Name)
+		}
+		clusters[cluster.Name] = true
+		if cluster.F < 1 {
+			return fmt.Errorf("cluster %s: f must be at least 1", cluster.Name)
+		}
+		if len(cluster.Nodes) < 3*cluster.F+1 {
+			return fmt.Errorf("cluster %s: %d nodes cannot tolerate f=%d, need at least %d", cluster.Name, len(cluster.Nodes), cluster.F, 3*cluster.F+1)
+		}
+		if cluster.ClientURL == "" {
+			return fmt.Errorf("cluster %s has no clientURL", cluster.Name)
+		}
+		for j, node := range cluster.Nodes {
+			if expected := cluster.Name + strconv.Itoa(j); node.ID != expected {
+				return fmt.Errorf("cluster %s: node %d is named %q, expect %q", cluster.Name, j, node.ID, expected)
+			}
+			if node.URL == "" {
+				return fmt.Errorf("node %s has no url", node.ID)
+			}
+			if _, err := ParseBehaviours(node.ByzantineSpec()); err != nil {
+				return fmt.Errorf("node %s: %s", node.ID, err)
+			}
+			if other, ok := urls[node.URL]; ok {
+				return fmt.Errorf("nodes %s and %s share the url %s", other, node.ID, node.URL)
+			}
+			urls[node.URL] = node.ID
+		}
+	}
+	return nil
+}
+
+// Cluster 返回名为 name 的集群
+func (config *Config) Cluster(name string) (*ClusterConfig, bool) {
+	for _, cluster := range config.Clusters {
+		if cluster.Name == name {
+			return cluster, true
+		}
+	}
+	return nil, false
+}
+
+// Node 返回节点 nodeID 及其所在的集群
+func (config *Config) Node(nodeID string) (*ClusterConfig, *NodeConfig, bool) {
+	for _, cluster := range config.Clusters {
+		for _, node := range cluster.Nodes {
+			if node.ID == nodeID {
+				return cluster, node, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// NodeTable 以 cluster - nodeID - url 的形式返回所有节点
+func (config *Config) NodeTable() map[string]map[string]string {
+	nodeTable := make(map[string]map[string]string)
+	for _, cluster := range config.Clusters {
+		nodeTable[cluster.Name] = make(map[string]string)
+		for _, node := range cluster.Nodes {
+			nodeTable[cluster.Name][node.ID] = node.URL
+		}
+	}
+	return nodeTable
+}
+
+// Apply 用配置替换集群拓扑和参数的默认值，cluster 为本节点或客户端所在的集群，
+// 本集群的 f 会写入 consensus.F
+func (config *Config) Apply(cluster string) error {
+	own, ok := config.Cluster(cluster)
+	if !ok {
+		return fmt.Errorf("cluster %s is not configured", cluster)
+	}
+
+	Allcluster = make([]string, 0, len(config.Clusters))
+	PrimaryNode = make(map[string]string)
+	ClientURL = make(map[string]string)
+	ClusterF = make(map[string]int)
+	for _, c := range config.Clusters {
+		Allcluster = append(Allcluster, c.Name)
+		PrimaryNode[c.Name] = c.Nodes[0].ID
+		ClientURL[c.Name] = c.ClientURL
+		ClusterF[c.Name] = c.F
+	}
+	ClusterNumber = len(Allcluster)
+	consensus.F = own.F
+
+	if config.KeysDir != "" {
+		KeysDir = config.KeysDir
+	}
+	if config.LedgerDir != "" {
+		LedgerDir = config.LedgerDir
+	}
+	if config.WALDir != "" {
+		WALDir = config.WALDir
+	}
+	if config.MaxBatchSize > 0 {
+		consensus.MaxBatchSize = config.MaxBatchSize
+	}
+	if config.MaxBatchDelayMs > 0 {
+		consensus.MaxBatchDelay = time.Duration(config.MaxBatchDelayMs) * time.Millisecond
+	}
+	if config.ViewChangeTimeoutMs > 0 {
+		ViewChangeTimeout = time.Duration(config.ViewChangeTimeoutMs) * time.Millisecond
+		RemoteViewChangeTimeout = 2 * ViewChangeTimeout
+	}
+	if config.RemoteViewChangeTimeoutMs > 0 {
+		RemoteViewChangeTimeout = time.Duration(config.RemoteViewChangeTimeoutMs) * time.Millisecond
+	}
+	if config.RotateShareReceivers != nil {
+		RotateShareReceivers = *config.RotateShareReceivers
+	}
+	if config.EpochLength > 0 {
+		EpochLength = config.EpochLength
+	}
+	if config.ByzantineDelayMs > 0 {
+		ByzantineDelay = time.Duration(config.ByzantineDelayMs) * time.Millisecond
+	}
+	loadedConfig = config
+	return nil
+}
+
+// loadNodeTable 有配置文件时使用其中的节点，否则读取 nodetable.txt
+func loadNodeTable() map[string]map[string]string {
+	if loadedConfig != nil {
+		return loadedConfig.NodeTable()
+	}
+	return LoadNodeTable("nodetable.txt")
+}
+
+// clusterF 返回集群 cluster 的容错数
+func clusterF(cluster string) int {
+	if f, ok := ClusterF[cluster]; ok {
+		return f
+	}
+	return consensus.F
+}
+
+// keyFile 返回节点公钥或私钥文件的路径，suffix 为 _RSA_PUB 或 _RSA_PIV
+func keyFile(cluster string, nodeID string, suffix string) string {
+	if loadedConfig != nil {
+		if _, node, ok := loadedConfig.Node(nodeID); ok {
+			if suffix == "_RSA_PUB" && node.PublicKey != "" {
+				return node.PublicKey
+			}
+			if suffix == "_RSA_PIV" && node.PrivateKey != "" {
+				return node.PrivateKey
+			}
+		}
+	}
+	return filepath.Join(KeysDir, cluster, nodeID, nodeID+suffix)
+}
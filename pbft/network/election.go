@@ -0,0 +1,267 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EpochLength 每个纪元包含的全局轮次数，执行完第 k*EpochLength 轮后按信誉分数选举第 k 个纪元的主节点
+var EpochLength int64 = 5 * consensus.CheckpointPeriod
+
+// ViewsPerEpoch 每个纪元占用的视图编号数量，纪元 k 的视图为 [k*ViewsPerEpoch, (k+1)*ViewsPerEpoch)，
+// 视图 v 的主节点为该纪元委员会中的第 v mod ViewsPerEpoch 个节点。纪元 0 的委员会是编号最小的 3f+1 个节点，
+// 同一纪元内的视图切换次数不会达到 ViewsPerEpoch
+const ViewsPerEpoch = 1000
+
+// electPrimaries 执行完序号 sequenceID 对应的全局轮次后调用，到达纪元边界时为每个集群按分数从高到低排列候选节点，
+// 排名前 3f+1 的节点组成该纪元的委员会，其余节点作为观察节点只跟随执行。分数相同时优先保留报告中最新视图的主节点，
+// 其次是当前的委员会节点，其余按节点编号排列，避免分数都达到上限后反复更换主节点和委员会。
+// 所有节点执行相同的轮次，因此得到相同的排名，调用时需持有 GlobalViewIDLock
+func (node *Node) electPrimaries(sequenceID int64) {
+	if EpochLength <= 0 || sequenceID%EpochLength != 0 {
+		return
+	}
+	epoch := sequenceID / EpochLength
+
+	rep := node.Reputation
+	rep.Lock.Lock()
+	previous := make(map[string][]string)
+	rankings := make(map[string][]string)
+	for i := 0; i < ClusterNumber; i++ {
+		cluster := Allcluster[i]
+		current := node.primaryOf(cluster, rep.Views[cluster])
+		previous[cluster] = node.committeeOf(cluster, rep.Epoch*ViewsPerEpoch)
+		inCommittee := make(map[string]bool)
+		for _, member := range previous[cluster] {
+			inCommittee[member] = true
+		}
+		// 只有当前的委员会节点和最近一个纪元内在报告中出现过的节点参与排名，
+		// 没有运行或从未提交过 commit 的节点保持初始分数，不能替换在线的节点
+		ranking := make([]string, 0, len(previous[cluster]))
+		for _, nodeID := range node.clusterNodes(cluster) {
+			if inCommittee[nodeID] || rep.live(cluster, nodeID, sequenceID) {
+				ranking = append(ranking, nodeID)
+			}
+		}
+		sort.SliceStable(ranking, func(a, b int) bool {
+			scoreA, scoreB := rep.score(cluster, ranking[a]), rep.score(cluster, ranking[b])
+			if scoreA != scoreB {
+				return scoreA > scoreB
+			}
+			if (ranking[a] == current) != (ranking[b] == current) {
+				return ranking[a] == current
+			}
+			return inCommittee[ranking[a]] && !inCommittee[ranking[b]]
+		})
+		rankings[cluster] = ranking[:len(clusterMembers(cluster))]
+	}
+	rep.Elections[epoch] = rankings
+	rep.Epoch = epoch
+	rep.Lock.Unlock()
+
+	elected := make(map[string]string)
+	for cluster, ranking := range rankings {
+		elected[cluster] = ranking[0]
+	}
+	fmt.Printf("纪元 %d 选举出的主节点: %v\n", epoch, elected)
+	if promoted, demoted := diffMembers(previous[node.ClusterName], rankings[node.ClusterName]); len(promoted)+len(demoted) > 0 {
+		fmt.Printf("纪元 %d 的委员会: %v，提升为委员会节点: %v，降为观察节点: %v\n", epoch, rankings[node.ClusterName], promoted, demoted)
+	}
+}
+
+// primaryOf 与 PrimaryOf 相同，调用时需持有 Reputation.Lock。所在纪元尚未选举时返回空字符串
+func (node *Node) primaryOf(cluster string, viewNumber int64) string {
+	committee := node.committeeOf(cluster, viewNumber)
+	if len(committee) == 0 {
+		return ""
+	}
+	return committee[(viewNumber%ViewsPerEpoch)%int64(len(committee))]
+}
+
+// committeeOf 返回视图 viewNumber 中集群 cluster 可以投票的 3f+1 个委员会节点，按主节点轮换的顺序排列。
+// 纪元 0 的委员会是编号最小的 3f+1 个节点，所在纪元尚未选举时返回 nil，调用时需持有 Reputation.Lock
+func (node *Node) committeeOf(cluster string, viewNumber int64) []string {
+	epoch := viewNumber / ViewsPerEpoch
+	if epoch == 0 {
+		return clusterMembers(cluster)
+	}
+	return node.Reputation.Elections[epoch][cluster]
+}
+
+// Committee 返回视图 viewNumber 中集群 cluster 的委员会节点
+func (node *Node) Committee(cluster string, viewNumber int64) []string {
+	node.Reputation.Lock.Lock()
+	defer node.Reputation.Lock.Unlock()
+	return node.committeeOf(cluster, viewNumber)
+}
+
+// inCommittee 判断 nodeID 是否是视图 viewNumber 中集群 cluster 的委员会节点
+func (node *Node) inCommittee(cluster string, viewNumber int64, nodeID string) bool {
+	for _, member := range node.Committee(cluster, viewNumber) {
+		if member == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// isObserver 本节点不在当前视图的委员会中时只验证并执行已提交的批次，不参与投票、视图切换和回复客户端
+func (node *Node) isObserver() bool {
+	return !node.inCommittee(node.ClusterName, node.View.Number, node.NodeID)
+}
+
+// clusterNodes 返回集群中的所有节点，按节点编号排列。节点表中少于 3f+1 个节点时补足编号最小的 3f+1 个节点
+func (node *Node) clusterNodes(cluster string) []string {
+	index := make(map[string]int)
+	for _, member := range clusterMembers(cluster) {
+		index[member], _ = strconv.Atoi(strings.TrimPrefix(member, cluster))
+	}
+	for nodeID := range node.NodeTable[cluster] {
+		i, err := strconv.Atoi(strings.TrimPrefix(nodeID, cluster))
+		if err != nil {
+			continue
+		}
+		index[nodeID] = i
+	}
+	nodes := make([]string, 0, len(index))
+	for nodeID := range index {
+		nodes = append(nodes, nodeID)
+	}
+	sort.Slice(nodes, func(a, b int) bool { return index[nodes[a]] < index[nodes[b]] })
+	return nodes
+}
+
+// diffMembers 返回从委员会 before 变为 after 时新加入和被移出的节点
+func diffMembers(before []string, after []string) ([]string, []string) {
+	inBefore := make(map[string]bool)
+	for _, member := range before {
+		inBefore[member] = true
+	}
+	inAfter := make(map[string]bool)
+	promoted := make([]string, 0)
+	for _, member := range after {
+		inAfter[member] = true
+		if !inBefore[member] {
+			promoted = append(promoted, member)
+		}
+	}
+	demoted := make([]string, 0)
+	for _, member := range before {
+		if !inAfter[member] {
+			demoted = append(demoted, member)
+		}
+	}
+	return promoted, demoted
+}
+
+// electionView 返回最近一次选举的纪元的第一个视图，还没有选举过时返回 0
+func (node *Node) electionView() int64 {
+	node.Reputation.Lock.Lock()
+	defer node.Reputation.Lock.Unlock()
+	return node.Reputation.Epoch * ViewsPerEpoch
+}
+
+// nextView 返回替换视图 view 的主节点时切换到的视图。最近一次选举的纪元比 view 新时直接进入该纪元，
+// 如果该纪元排名第一的节点就是要被替换的主节点，则进入该纪元的第二个视图
+func (node *Node) nextView(view int64) int64 {
+	first := node.electionView()
+	if first <= view {
+		return view + 1
+	}
+	if node.PrimaryOf(node.ClusterName, first) == node.PrimaryOf(node.ClusterName, view) {
+		return first + 1
+	}
+	return first
+}
+
+// checkElection 由 resolveMsg 在 alarm 到期时调用，选举出的主节点或委员会与当前视图不同时，
+// 通过视图切换进入新纪元的第一个视图。之前因为尚未执行选举而无法验证的 NEW-VIEW 在这里重新处理
+func (node *Node) checkElection() {
+	node.ViewChange.Lock.Lock()
+	deferred := node.ViewChange.Deferred
+	node.ViewChange.Lock.Unlock()
+	if deferred != nil && node.PrimaryOf(node.ClusterName, deferred.NewView) != "" {
+		node.ViewChange.Lock.Lock()
+		node.ViewChange.Deferred = nil
+		node.ViewChange.Lock.Unlock()
+		if err := node.GetNewView(deferred); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	first := node.electionView()
+	if first <= node.View.Number {
+		return
+	}
+	node.ViewChange.Lock.Lock()
+	pending := node.ViewChange.Changing && node.ViewChange.PendingView >= first
+	node.ViewChange.Lock.Unlock()
+	if pending {
+		return
+	}
+	elected := node.PrimaryOf(node.ClusterName, first)
+	promoted, demoted := diffMembers(node.Committee(node.ClusterName, node.View.Number), node.Committee(node.ClusterName, first))
+	if elected == node.View.Primary && len(promoted)+len(demoted) == 0 {
+		return
+	}
+	fmt.Printf("纪元 %d 选举出的主节点 %s (当前 %s)，委员会变化 +%v -%v，切换到视图 %d\n", first/ViewsPerEpoch, elected, node.View.Primary, promoted, demoted, first)
+	node.startViewChange(first)
+}
+
+// announcePrimary 选举出的主节点进入新纪元的第一个视图后通知其他集群的所有节点
+func (node *Node) announcePrimary(viewNumber int64) {
+	msg := &consensus.PrimaryChangeMsg{
+		Cluster:    node.ClusterName,
+		ViewNumber: viewNumber,
+		NodeID:     node.NodeID,
+	}
+	msg.Digest, msg.Sign = node.signMsg(msg)
+	for i := 0; i < ClusterNumber; i++ {
+		if Allcluster[i] != node.ClusterName {
+			node.Broadcast(Allcluster[i], msg, "/primarychange")
+		}
+	}
+}
+
+// GetPrimaryChange 其他集群的新主节点的通知，只接受纪元第一个视图中由选举结果确定的主节点
+func (node *Node) GetPrimaryChange(msg *consensus.PrimaryChangeMsg) error {
+	if msg.Cluster == node.ClusterName {
+		return fmt.Errorf("primary change from own cluster %s", msg.Cluster)
+	}
+	if _, ok := node.NodeTable[msg.Cluster][msg.NodeID]; !ok {
+		return fmt.Errorf("primary change from unknown node %s", msg.NodeID)
+	}
+	if msg.ViewNumber == 0 || msg.ViewNumber%ViewsPerEpoch != 0 {
+		return fmt.Errorf("view %d of cluster %s is not the first view of an epoch", msg.ViewNumber, msg.Cluster)
+	}
+	if msg.NodeID != node.PrimaryOf(msg.Cluster, msg.ViewNumber) {
+		return fmt.Errorf("%s is not elected for view %d of cluster %s", msg.NodeID, msg.ViewNumber, msg.Cluster)
+	}
+	if msg.Digest != primaryChangeDigest(msg) {
+		return fmt.Errorf("digest of primary change from %s mismatch", msg.NodeID)
+	}
+	digestByte, _ := hex.DecodeString(msg.Digest)
+	if !node.validSign(digestByte, msg.Sign, node.getPubKey(msg.Cluster, msg.NodeID)) {
+		return fmt.Errorf("signature of primary change from %s is invalid", msg.NodeID)
+	}
+
+	node.ClusterViewsLock.Lock()
+	defer node.ClusterViewsLock.Unlock()
+	if msg.ViewNumber > node.ClusterViews[msg.Cluster] {
+		node.ClusterViews[msg.Cluster] = msg.ViewNumber
+		fmt.Printf("集群 %s 进入视图 %d，主节点为 %s\n", msg.Cluster, msg.ViewNumber, msg.NodeID)
+	}
+	return nil
+}
+
+func primaryChangeDigest(msg *consensus.PrimaryChangeMsg) string {
+	unsigned := *msg
+	unsigned.Digest, unsigned.Sign = "", nil
+	jsonMsg, _ := json.Marshal(&unsigned)
+	return consensus.Hash(jsonMsg)
+}
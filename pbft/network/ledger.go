@@ -0,0 +1,280 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"simple_pbft/pbft/consensus"
+	"sync"
+)
+
+// LedgerDir 区块账本所在的目录，每个节点一个文件，为空时不保存账本
+var LedgerDir = "ledger"
+
+// Ledger 追加写入的区块账本，每个区块是一行 JSON，写入后立即 fsync
+type Ledger struct {
+	file     *os.File
+	lock     sync.Mutex
+	height   int64            // 文件中最后一个区块的高度
+	size     int64            // 文件中完整区块的总长度
+	offsets  map[int64]int64  // height - 区块在文件中的起始位置
+	requests map[string]int64 // clientID-timestamp - 请求第一次出现的区块高度
+}
+
+// OpenLedger 打开(或创建)节点的区块账本，崩溃时写了一半的最后一个区块会被截掉
+func OpenLedger(nodeID string) (*Ledger, error) {
+	if LedgerDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(LedgerDir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(LedgerDir, nodeID+".ledger"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	blocks, offsets, err := readBlocks(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	ledger := &Ledger{
+		file:     file,
+		size:     offsets[len(blocks)],
+		offsets:  make(map[int64]int64),
+		requests: make(map[string]int64),
+	}
+	if err := file.Truncate(ledger.size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	for i, block := range blocks {
+		ledger.index(block, offsets[i])
+	}
+	return ledger, nil
+}
+
+// index 记录区块的位置以及其中的请求，调用时需持有 lock
+func (ledger *Ledger) index(block *consensus.Block, offset int64) {
+	ledger.height = block.Height
+	ledger.offsets[block.Height] = offset
+	for _, reqMsg := range block.Requests() {
+		if _, ok := ledger.requests[requestKey(reqMsg)]; !ok {
+			ledger.requests[requestKey(reqMsg)] = block.Height
+		}
+	}
+}
+
+// Append 写入一个区块并 fsync，重放预写日志时重新生成的已保存区块会被跳过
+func (ledger *Ledger) Append(block *consensus.Block) {
+	if ledger == nil {
+		return
+	}
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	if block.Height <= ledger.height {
+		return
+	}
+	if ledger.height > 0 && block.Height != ledger.height+1 {
+		// 通过快照追上的节点没有中间的区块，审计时需要使用其他节点完整的账本
+		fmt.Printf("账本缺少高度 %d 到 %d 的区块\n", ledger.height+1, block.Height-1)
+	}
+	line, err := json.Marshal(block)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	line = append(line, '\n')
+	if _, err := ledger.file.Write(line); err != nil {
+		fmt.Printf("write ledger: %s\n", err)
+		return
+	}
+	if err := ledger.file.Sync(); err != nil {
+		fmt.Printf("sync ledger: %s\n", err)
+	}
+	ledger.index(block, ledger.size)
+	ledger.size += int64(len(line))
+}
+
+// Height 返回账本中最后一个区块的高度
+func (ledger *Ledger) Height() int64 {
+	if ledger == nil {
+		return 0
+	}
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	return ledger.height
+}
+
+// Block 从文件中读取高度为 height 的区块
+func (ledger *Ledger) Block(height int64) (*consensus.Block, error) {
+	if ledger == nil {
+		return nil, nil
+	}
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	offset, ok := ledger.offsets[height]
+	if !ok {
+		return nil, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(ledger.file, offset, ledger.size-offset))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	block := new(consensus.Block)
+	if err := json.Unmarshal(line, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// FindRequest 返回包含请求 (clientID, timestamp) 的区块，请求尚未写入账本时返回 nil
+func (ledger *Ledger) FindRequest(clientID string, timestamp int64) (*consensus.Block, error) {
+	if ledger == nil {
+		return nil, nil
+	}
+	ledger.lock.Lock()
+	height, ok := ledger.requests[requestKey(&consensus.RequestMsg{ClientID: clientID, Timestamp: timestamp})]
+	ledger.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return ledger.Block(height)
+}
+
+// readBlocks 从头读取所有完整的区块，offsets[i] 是第 i 个区块的起始位置，最后一个元素是完整区块的总长度
+func readBlocks(file *os.File) ([]*consensus.Block, []int64, error) {
+	blocks := make([]*consensus.Block, 0)
+	offsets := []int64{0}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return blocks, offsets, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println("ignore incomplete block")
+			}
+			return blocks, offsets, nil
+		}
+		if err != nil {
+			return blocks, offsets, err
+		}
+		block := new(consensus.Block)
+		if err := json.Unmarshal(line, block); err != nil {
+			fmt.Printf("ignore corrupted block: %s\n", err)
+			return blocks, offsets, nil
+		}
+		blocks = append(blocks, block)
+		offsets = append(offsets, offsets[len(offsets)-1]+int64(len(line)))
+	}
+}
+
+// appendBlock 把轮次 ViewID 中各集群的批次及其证明按执行顺序打包成区块，接在上一个区块之后，调用时需持有 GlobalViewIDLock
+func (node *Node) appendBlock(ViewID int64) {
+	batches := make([]*consensus.BlockBatch, 0, ClusterNumber)
+	for _, cluster := range consensus.ExecutionOrder(Allcluster[:ClusterNumber]) {
+		msg, _ := node.GlobalLog.Get(cluster, ViewID)
+		jsonMsg, err := json.Marshal(msg)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		batch := &consensus.BlockBatch{
+			Cluster:    cluster,
+			RequestMsg: msg,
+			Digest:     consensus.Hash(jsonMsg),
+		}
+		if cluster == node.ClusterName {
+			if cert, ok := node.GlobalLog.GetCert(ViewID); ok && cert != nil {
+				batch.CommitMsgs = cert.CommitMsgs
+			}
+		} else if shareMsg, ok := node.GlobalLog.GetShare(cluster, ViewID); ok {
+			batch.CommitMsgs = shareMsg.CommitMsgs
+			batch.NodeID = shareMsg.NodeID
+			batch.ViewNumber = shareMsg.ViewNumber
+			batch.Sign = shareMsg.Sign
+		}
+		batches = append(batches, batch)
+	}
+
+	block := consensus.NewBlock(sequenceOfViewID(ViewID), ViewID, node.BlockHash, batches)
+	node.BlockHash = block.Hash
+	node.Ledger.Append(block)
+}
+
+// ReadLedger 读取账本文件中的所有区块
+func ReadLedger(path string) ([]*consensus.Block, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	blocks, _, err := readBlocks(file)
+	return blocks, err
+}
+
+// VerifyLedger 离线校验账本文件：区块从高度 1 开始连续且哈希链接正确，Merkle 根与请求一致，
+// 每个批次带有其所在集群 2f+1 个节点的 commit 投票，返回校验通过的区块数
+func VerifyLedger(path string) (int, error) {
+	blocks, err := ReadLedger(path)
+	if err != nil {
+		return 0, err
+	}
+	auditor := &Node{NodeTable: loadNodeTable(), Reputation: NewReputation()}
+	// 其他集群批次的签名者由视图所在纪元的选举决定，先按顺序重放所有区块中的参与报告和选举
+	for _, block := range blocks {
+		for _, batch := range block.Batches {
+			if batch.RequestMsg != nil {
+				auditor.applyReports(batch.Cluster, batch.RequestMsg)
+			}
+		}
+		auditor.electPrimaries(sequenceOfViewID(block.ViewID))
+	}
+
+	prevHash := ""
+	for i, block := range blocks {
+		if block.Height != int64(i+1) {
+			return i, fmt.Errorf("block %d: expect height %d, blocks before it are missing", block.Height, i+1)
+		}
+		if err := block.Verify(prevHash); err != nil {
+			return i, err
+		}
+		for _, batch := range block.Batches {
+			if err := auditor.verifyBlockBatch(block, batch); err != nil {
+				return i, err
+			}
+		}
+		prevHash = block.Hash
+	}
+	return len(blocks), nil
+}
+
+// verifyBlockBatch 检查批次所属的轮次、commit 投票以及其他集群主节点的签名
+func (node *Node) verifyBlockBatch(block *consensus.Block, batch *consensus.BlockBatch) error {
+	if batch.RequestMsg == nil || batch.RequestMsg.SequenceID != sequenceOfViewID(block.ViewID) {
+		return fmt.Errorf("block %d: batch of %s is not bound to round %d", block.Height, batch.Cluster, block.ViewID)
+	}
+	if err := node.verifyCommitVotes(batch.Cluster, batch.Digest, block.ViewID, batch.CommitMsgs); err != nil {
+		return fmt.Errorf("block %d: %s", block.Height, err)
+	}
+	if batch.NodeID == "" {
+		return nil
+	}
+	// 其他集群的批次还附带其主节点的签名
+	if batch.NodeID != node.PrimaryOf(batch.Cluster, batch.ViewNumber) {
+		return fmt.Errorf("block %d: batch of %s is not signed by its primary", block.Height, batch.Cluster)
+	}
+	digestByte, _ := hex.DecodeString(batch.Digest)
+	if err := node.RsaVerySignWithSha256(digestByte, batch.Sign, node.getPubKey(batch.Cluster, batch.NodeID)); err != nil {
+		return fmt.Errorf("block %d: invalid signature in batch of %s: %s", block.Height, batch.Cluster, err)
+	}
+	return nil
+}
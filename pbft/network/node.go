@@ -16,6 +16,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"simple_pbft/pbft/application"
 	"simple_pbft/pbft/consensus"
 	"strconv"
 	"strings"
@@ -27,9 +28,11 @@ type Node struct {
 	NodeID         string
 	NodeTable      map[string]map[string]string // key=nodeID, value=url
 	NodeType       MaliciousNode
+	Byzantine      *Byzantine // 恶意节点启用的拜占庭行为
 	View           *View
-	CurrentState   *consensus.State
-	CommittedMsgs  []*consensus.RequestMsg // kinda block.
+	States         map[int64]*consensus.State // SequenceID - 共识实例，水位之间的多个序号可以同时进行共识
+	StatesLock     sync.RWMutex               // 只有 resolveMsg 修改 States、View 和 CommittedSequenceID，其他协程读取时需要加锁
+	CommittedMsgs  []*consensus.RequestMsg    // kinda block.
 	MsgBuffer      *MsgBuffer
 	MsgEntrance    chan interface{}
 	MsgDelivery    chan interface{}
@@ -37,7 +40,11 @@ type Node struct {
 
 	AcceptRequestTime map[int64]time.Time // req SequenceID -> Start time
 
+	CommittedSequenceID int64 // 最近一次完成本地共识的序号，序号从 1 开始连续分配
+
 	Alarm chan bool
+	// alarm 到期后通知 resolveMsg 检查请求计时器以及本节点是否落后
+	TimerCheck chan bool
 	// 全局消息日志和临时消息缓冲区
 	GlobalLog    *consensus.GlobalLog
 	GlobalBuffer *GlobalBuffer
@@ -60,6 +67,43 @@ type Node struct {
 	//全局消息接受通道和处理通道
 	MsgGlobal         chan interface{}
 	MsgGlobalDelivery chan interface{}
+
+	// 视图切换状态与请求计时器
+	ViewChange *ViewChangeState
+	// 其他集群不发送批次时请求其替换主节点
+	RemoteViewChange *RemoteViewChangeState
+	// 备份节点转发给主节点但尚未提交的客户端请求
+	ForwardedReqs     map[string]*consensus.RequestMsg // clientID-timestamp - msg
+	ForwardedReqsLock sync.Mutex
+	// 其他集群已知的最新视图编号，用于确认全局共享消息是否来自其主节点
+	ClusterViews     map[string]int64
+	ClusterViewsLock sync.Mutex
+	// 每个发送者被丢弃的无效消息数量，签名无效或内容错误的消息不会计入法定人数
+	InvalidMsgs     map[string]int
+	InvalidMsgsLock sync.Mutex
+
+	// 检查点
+	StableCheckpoint *consensus.Checkpoint
+	CheckpointMsgs   map[int64]map[string]*consensus.CheckpointMsg // sequenceID - nodeID - msg
+	StateDigest      string                                        // 到最近一次执行的全局轮次为止的状态摘要
+	BlockHash        string                                        // 最近一次执行的全局轮次的区块哈希
+	CommittedBase    int                                           // 已经被截断的 CommittedMsgs 数量
+	Snapshots        map[int64]*consensus.Snapshot                 // sequenceID - 快照，由 GlobalViewIDLock 保护
+
+	// 状态传输，落后的节点从本集群其他节点获取缺失的状态
+	StateTransfer *StateTransfer
+
+	// 复制状态机，全局共识完成后按顺序执行请求
+	App application.StateMachine
+	// 每个客户端的回复缓存，重复的请求不会被再次执行
+	ClientTable *ClientTable
+	// 各集群节点的信誉分数
+	Reputation *Reputation
+
+	// 预写日志，节点重启后据此恢复状态
+	WAL *WAL
+	// 全局轮次按哈希链接成的区块账本
+	Ledger *Ledger
 }
 
 type MsgBufferLock struct {
@@ -67,6 +111,8 @@ type MsgBufferLock struct {
 	PrePrepareMsgsLock sync.Mutex
 	PrepareMsgsLock    sync.Mutex
 	CommitMsgsLock     sync.Mutex
+	ViewChangeMsgsLock sync.Mutex
+	CheckpointMsgsLock sync.Mutex
 }
 
 type GlobalBuffer struct {
@@ -79,12 +125,23 @@ type MsgBuffer struct {
 	PrePrepareMsgs []*consensus.PrePrepareMsg
 	PrepareMsgs    []*consensus.VoteMsg
 	CommitMsgs     []*consensus.VoteMsg
-	BatchReqMsgs   []*consensus.BatchRequestMsg
+	BatchReqMsgs   map[int64]*consensus.BatchRequestMsg // SequenceID - batch
+	ViewChangeMsgs []*consensus.ViewChangeMsg
+	NewViewMsgs    []*consensus.NewViewMsg
+	// 远程视图切换消息，与 ViewChangeMsgs 共用 ViewChangeMsgsLock
+	RemoteViewChangeMsgs []*consensus.RemoteViewChangeMsg
+	PrimaryChangeMsgs    []*consensus.PrimaryChangeMsg
+	CheckpointMsgs       []*consensus.CheckpointMsg
+	// 状态传输消息，与 CheckpointMsgs 共用 CheckpointMsgsLock
+	FetchStateMsgs    []*consensus.FetchStateMsg
+	StateTransferMsgs []*consensus.StateTransferMsg
+	BatchStartTime    time.Time // 缓存中尚未打包的最早请求开始等待的时间
 }
 
 type View struct {
-	ID      int64
+	ID      int64 // 本地共识轮次，每完成一次本地共识加一
 	Primary string
+	Number  int64 // PBFT 视图编号，每次视图切换加一，主节点由它决定
 }
 
 var PrimaryNode = map[string]string{
@@ -106,6 +163,14 @@ var Allcluster = []string{"N", "M", "P", "J", "K"}
 var ClusterNumber = 5
 var IsMaliciousNode = "No"
 
+// RotateShareReceivers 其他集群接收全局共享消息的 f+1 个节点是否随轮次轮换
+var RotateShareReceivers = true
+
+// NewStateMachine 创建节点使用的复制状态机，需要在 NewServer 之前设置
+var NewStateMachine = func() application.StateMachine {
+	return application.NewNoopApp()
+}
+
 const ResolvingTimeDuration = time.Millisecond * 1000 // 1 second.
 
 func NewNode(nodeID string, clusterName string) *Node {
@@ -120,17 +185,26 @@ func NewNode(nodeID string, clusterName string) *Node {
 		},
 
 		// Consensus-related struct
-		CurrentState:  nil,
+		States:        make(map[int64]*consensus.State),
 		CommittedMsgs: make([]*consensus.RequestMsg, 0),
 		MsgBuffer: &MsgBuffer{
-			ReqMsgs:        make([]*consensus.RequestMsg, 0),
-			PrePrepareMsgs: make([]*consensus.PrePrepareMsg, 0),
-			PrepareMsgs:    make([]*consensus.VoteMsg, 0),
-			CommitMsgs:     make([]*consensus.VoteMsg, 0),
-			BatchReqMsgs:   make([]*consensus.BatchRequestMsg, 0),
+			ReqMsgs:              make([]*consensus.RequestMsg, 0),
+			PrePrepareMsgs:       make([]*consensus.PrePrepareMsg, 0),
+			PrepareMsgs:          make([]*consensus.VoteMsg, 0),
+			CommitMsgs:           make([]*consensus.VoteMsg, 0),
+			BatchReqMsgs:         make(map[int64]*consensus.BatchRequestMsg),
+			ViewChangeMsgs:       make([]*consensus.ViewChangeMsg, 0),
+			NewViewMsgs:          make([]*consensus.NewViewMsg, 0),
+			RemoteViewChangeMsgs: make([]*consensus.RemoteViewChangeMsg, 0),
+			PrimaryChangeMsgs:    make([]*consensus.PrimaryChangeMsg, 0),
+			CheckpointMsgs:       make([]*consensus.CheckpointMsg, 0),
+			FetchStateMsgs:       make([]*consensus.FetchStateMsg, 0),
+			StateTransferMsgs:    make([]*consensus.StateTransferMsg, 0),
 		},
 		GlobalLog: &consensus.GlobalLog{
 			MsgLogs: make(map[string]map[int64]*consensus.BatchRequestMsg),
+			Shares:  make(map[string]map[int64]*consensus.GlobalShareMsg),
+			Certs:   make(map[int64]*consensus.CommitCert),
 		},
 		GlobalBuffer: &GlobalBuffer{
 			ReqMsg:       make([]*consensus.GlobalShareMsg, 0),
@@ -145,18 +219,39 @@ func NewNode(nodeID string, clusterName string) *Node {
 		MsgRequsetchan:    make(chan interface{}, 200),
 		AcceptRequestTime: make(map[int64]time.Time),
 
-		Alarm: make(chan bool),
+		Alarm:      make(chan bool),
+		TimerCheck: make(chan bool, 1),
 
 		// 所属集群
 		ClusterName:  clusterName,
 		GlobalViewID: viewID,
+
+		ViewChange:       NewViewChangeState(),
+		RemoteViewChange: NewRemoteViewChangeState(),
+		ForwardedReqs:    make(map[string]*consensus.RequestMsg),
+		ClusterViews:     make(map[string]int64),
+		InvalidMsgs:      make(map[string]int),
+
+		StableCheckpoint: &consensus.Checkpoint{SequenceID: 0},
+		CheckpointMsgs:   make(map[int64]map[string]*consensus.CheckpointMsg),
+		Snapshots:        make(map[int64]*consensus.Snapshot),
+		StateTransfer:    &StateTransfer{},
+
+		App:         NewStateMachine(),
+		ClientTable: NewClientTable(),
+		Reputation:  NewReputation(),
 	}
 
-	node.NodeTable = LoadNodeTable("nodetable.txt")
+	node.NodeTable = loadNodeTable()
 
-	if IsMaliciousNode != "No" {
+	byzantine, err := ParseBehaviours(IsMaliciousNode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.Byzantine = byzantine
+	if byzantine.IsMalicious() {
 		node.NodeType = isMaliciousNode
-		fmt.Println("Is malicious Node")
+		fmt.Printf("Is malicious Node: %s\n", byzantine)
 	} else {
 		node.NodeType = NonMaliciousNode
 		//fmt.Println("Not malicious Node")
@@ -174,17 +269,25 @@ func NewNode(nodeID string, clusterName string) *Node {
 	//	}
 	//}
 
-	// 初始化每个节点的分数为70分
-	//for cluster, nodes := range node.NodeTable {
-	//	node.ReScore[cluster] = make(map[string]uint8) // 为每个集群初始化内部 map
-	//	for _, _nodeID := range nodes {
-	//		node.ReScore[cluster][_nodeID] = 70
-	//	}
-	//}
+	// 每个节点的信誉分数从 InitialScore 开始，由执行的参与报告调整(见 reputation.go)
 
 	node.rsaPubKey = node.getPubKey(clusterName, nodeID)
 	node.rsaPrivKey = node.getPivKey(clusterName, nodeID)
-	node.CurrentState = consensus.CreateState(node.View.ID, -2)
+
+	// 打开预写日志，重启的节点从上次的视图和序号继续
+	wal, err := OpenWAL(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	node.WAL = wal
+	ledger, err := OpenLedger(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	node.Ledger = ledger
+	if err := node.replayWAL(); err != nil {
+		log.Panic(err)
+	}
 
 	lastViewId = 0
 	lastGlobalId = 0
@@ -246,13 +349,16 @@ func (node *Node) Broadcast(cluster string, msg interface{}, path string) map[st
 			continue
 		}
 
-		jsonMsg, err := json.Marshal(msg)
-		if err != nil {
-			errorMap[nodeID] = err
-			continue
+		// 恶意节点按启用的拜占庭行为篡改、扣留或重放消息
+		for _, out := range node.byzantineMsgs(cluster, nodeID, msg, path) {
+			jsonMsg, err := json.Marshal(out)
+			if err != nil {
+				errorMap[nodeID] = err
+				continue
+			}
+			//fmt.Printf("Send to %s Size of JSON message: %d bytes\n", url+path, len(jsonMsg))
+			node.deliver(url+path, jsonMsg)
 		}
-		//fmt.Printf("Send to %s Size of JSON message: %d bytes\n", url+path, len(jsonMsg))
-		send(url+path, jsonMsg)
 		time.Sleep(2 * time.Millisecond)
 
 	}
@@ -266,36 +372,75 @@ func (node *Node) Broadcast(cluster string, msg interface{}, path string) map[st
 
 // ShareLocalConsensus 本地达成共识后，主节点调用当前函数发送信息给其他集群的f+1个节点
 func (node *Node) ShareLocalConsensus(msg *consensus.GlobalShareMsg, path string) error {
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-
 	for i := 0; i < ClusterNumber; i++ {
 		cluster := Allcluster[i]
 		if cluster == node.ClusterName {
 			continue
 		}
-		for i := 0; i < consensus.F+1; i++ {
-			nodeID := cluster + strconv.Itoa(i)
+		for _, nodeID := range node.ShareReceivers(cluster, msg.ViewID) {
 			url, exists := node.NodeTable[cluster][nodeID]
 			if !exists {
 				fmt.Printf("NodeID %s not found in nodeMsg\n", nodeID)
 				continue
 			}
-			fmt.Printf("Send to %s Size of JSON message: %d bytes\n", url+path, len(jsonMsg))
-			send(url+path, jsonMsg)
+			for _, out := range node.byzantineMsgs(cluster, nodeID, msg, path) {
+				jsonMsg, err := json.Marshal(out)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Send to %s Size of JSON message: %d bytes\n", url+path, len(jsonMsg))
+				node.deliver(url+path, jsonMsg)
+			}
 		}
 	}
 	return nil
 }
 
+// ShareReceivers 返回集群 cluster 在轮次 viewID 接收全局共享消息的 f+1 个节点，其中至少有一个正常节点，
+// 每个接收节点都会把消息转发给本集群。接收节点从该集群当前视图的委员会中选出，
+// RotateShareReceivers 为 true 时随轮次轮换，否则固定为委员会的前 f+1 个节点
+func (node *Node) ShareReceivers(cluster string, viewID int64) []string {
+	// 观察节点不一定在线，只在 3f+1 个委员会节点中选择
+	node.ClusterViewsLock.Lock()
+	viewNumber := node.ClusterViews[cluster]
+	node.ClusterViewsLock.Unlock()
+	committee := node.Committee(cluster, viewNumber)
+	if len(committee) == 0 {
+		committee = clusterMembers(cluster)
+	}
+	f := clusterF(cluster)
+	n := int64(len(committee))
+	start := int64(0)
+	if RotateShareReceivers {
+		start = viewID % n
+	}
+	receivers := make([]string, 0, f+1)
+	for i := int64(0); i < int64(f+1) && i < n; i++ {
+		receivers = append(receivers, committee[(start+i)%n])
+	}
+	return receivers
+}
+
+// knownGlobalShare 已经保存或已经执行的轮次不再处理，f+1 个接收节点的重复转发在这里被丢弃
+func (node *Node) knownGlobalShare(msg *consensus.GlobalShareMsg) bool {
+	node.GlobalViewIDLock.Lock()
+	executed := msg.ViewID < node.GlobalViewID
+	node.GlobalViewIDLock.Unlock()
+	if executed {
+		return true
+	}
+	_, ok := node.GlobalLog.GetShare(msg.Cluster, msg.ViewID)
+	return ok
+}
+
 var start time.Time
 var duration time.Duration
 
 func (node *Node) Reply(ViewID int64) (bool, int64) {
 	for i := 0; i < ClusterNumber; i++ { //检查是否已经收到所有集群的消息
+		node.GlobalLog.Lock.RLock()
 		_, ok := node.GlobalLog.MsgLogs[Allcluster[i]]
+		node.GlobalLog.Lock.RUnlock()
 		if !ok {
 			fmt.Printf("1\n")
 			return false, 0
@@ -309,7 +454,7 @@ func (node *Node) Reply(ViewID int64) (bool, int64) {
 	//	}
 	//}
 	for i := 0; i < ClusterNumber; i++ { //检查是否已经收到所有集群当前阶段的可执行的消息
-		_, ok := node.GlobalLog.MsgLogs[Allcluster[i]][ViewID]
+		_, ok := node.GlobalLog.Get(Allcluster[i], ViewID)
 		if !ok {
 			fmt.Printf("2\n")
 			return false, 0
@@ -343,11 +488,19 @@ func (node *Node) Reply(ViewID int64) (bool, int64) {
 	//}
 	fmt.Print("\n\n\n\n\n")
 
+	// 先记录到预写日志再执行
+	node.WAL.Append(walExecute, &walRound{ViewID: ViewID})
 	node.GlobalViewID++
-	const viewID = 10000000000 // temporary.
-	if len(node.CommittedMsgs) == 1 {
+	replyMsgs, replyURLs := node.executeRound(ViewID)
+	// 每执行 CheckpointPeriod 个全局轮次生成一次检查点
+	if sequenceID := sequenceOfViewID(ViewID); sequenceID%consensus.CheckpointPeriod == 0 {
+		node.SendCheckpoint(sequenceID)
+	}
+
+	committedNum := node.CommittedBase + len(node.CommittedMsgs)
+	if committedNum == 1 {
 		//start = time.Now()
-	} else if len(node.CommittedMsgs) == 3000 && node.NodeID == "N0" {
+	} else if committedNum == 3000 && node.NodeID == "N0" {
 		duration = time.Since(start)
 		// 打开文件，如果文件不存在则创建，如果文件存在则追加内容
 		fmt.Printf("  Function took %s\n", duration)
@@ -366,47 +519,70 @@ func (node *Node) Reply(ViewID int64) (bool, int64) {
 			log.Fatal(err)
 		}
 
-	} else if len(node.CommittedMsgs) > 3000 && node.NodeID == "N0" {
+	} else if committedNum > 3000 && node.NodeID == "N0" {
 		fmt.Printf("  Function took %s\n", duration)
 		//fmt.Printf("  Function took %s\n", duration)
 		//fmt.Printf("  Function took %s\n", duration)
 	}
-	if node.NodeID == node.View.Primary { //主节点返回reply消息给客户端
-		go func() {
-			for i := 0; i < ClusterNumber; i++ { //检查是否已经收到所有集群当前阶段的可执行的消息
-				msg := node.GlobalLog.MsgLogs[Allcluster[i]][ViewID]
+	// 每个委员会节点都把执行结果返回给客户端，客户端收到 f+1 个相同的结果后接受
+	go func() {
+		for i, replyMsg := range replyMsgs {
+			node.sendReply(replyMsg, replyURLs[i])
+		}
+	}()
+	return true, ViewID + 1
+}
 
-				for i := 0; i < consensus.BatchSize; i++ {
-					node.CommittedMsgs = append(node.CommittedMsgs, msg.Requests[i])
-					//fmt.Printf("CommittedMsg: %v ", msg.Requests[i].Operation)
-				}
-			}
-			ReplyMsg := node.GlobalLog.MsgLogs[node.ClusterName][ViewID]
-			for i := 0; i < consensus.BatchSize; i++ {
-				jsonMsg, _ := json.Marshal(ReplyMsg.Requests[i])
-				// 系统中没有设置用户，reply消息直接发送给主节点
-				url := ClientURL[node.ClusterName] + "/reply"
-				send(url, jsonMsg)
-				fmt.Printf("\nReply to Client!\n")
+// executeRound 所有节点按 ExecutionOrder 依次执行每个集群在轮次 ViewID 提交的请求，重复的请求只执行一次，
+// 返回需要回复本集群客户端的消息
+func (node *Node) executeRound(ViewID int64) ([]*consensus.ReplyMsg, []string) {
+	replyMsgs := make([]*consensus.ReplyMsg, 0)
+	replyURLs := make([]string, 0)
+	for _, cluster := range consensus.ExecutionOrder(Allcluster[:ClusterNumber]) {
+		msg, _ := node.GlobalLog.Get(cluster, ViewID)
+		node.saveCommittedDigest(msg)
+		node.applyReports(cluster, msg)
+
+		for _, reqMsg := range msg.Requests {
+			replyMsg := node.executeRequest(reqMsg)
+			node.CommittedMsgs = append(node.CommittedMsgs, reqMsg)
+			//fmt.Printf("CommittedMsg: %v ", reqMsg.Operation)
+
+			// 本集群的客户端请求需要回复执行结果
+			if cluster == node.ClusterName && replyMsg != nil {
+				replyMsgs = append(replyMsgs, replyMsg)
+				replyURLs = append(replyURLs, reqMsg.URL)
 			}
-		}()
+		}
 	}
-	return true, ViewID + 1
+	node.electPrimaries(sequenceOfViewID(ViewID))
+	node.appendBlock(ViewID)
+	if sequenceID := sequenceOfViewID(ViewID); sequenceID%consensus.CheckpointPeriod == 0 {
+		node.takeSnapshot(sequenceID)
+		if node.StableCheckpoint.SequenceID == sequenceID {
+			node.compactWAL(node.StableCheckpoint)
+		}
+	}
+	// 已执行且低于稳定检查点的日志可以删除
+	node.truncateGlobalLog()
+
+	return replyMsgs, replyURLs
 }
 
-// GetReq can be called when the node's CurrentState is nil.
+// GetReq 主节点为批次分配下一个序号，不需要等待之前的序号完成共识
 // Consensus start procedure for the Primary.
 func (node *Node) GetReq(reqMsg *consensus.BatchRequestMsg, goOn bool) error {
 	LogMsg(reqMsg)
 
 	// Create a new state for the new consensus.
-	err := node.createStateForNewConsensus(goOn)
+	state, err := node.createStateForNewConsensus(node.nextSequenceID(), goOn)
 	if err != nil {
 		return err
 	}
+	node.attachReports(reqMsg)
 
 	// Start the consensus process.
-	prePrepareMsg, err := node.CurrentState.StartConsensus(reqMsg)
+	prePrepareMsg, err := state.StartConsensus(reqMsg)
 	if err != nil {
 		return err
 	}
@@ -416,13 +592,15 @@ func (node *Node) GetReq(reqMsg *consensus.BatchRequestMsg, goOn bool) error {
 	signInfo := node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
 	prePrepareMsg.Sign = signInfo
 
-	LogStage(fmt.Sprintf("Consensus Process (ViewID:%d)", node.CurrentState.ViewID), false)
+	LogStage(fmt.Sprintf("Consensus Process (ViewID:%d, SequenceID:%d)", state.ViewID, prePrepareMsg.SequenceID), false)
 
 	// Send getPrePrepare message
 	if prePrepareMsg != nil {
 		// 附加主节点ID,用于数字签名验证
 		prePrepareMsg.NodeID = node.NodeID
+		prePrepareMsg.ViewNumber = node.View.Number
 
+		node.WAL.Append(walPrePrepare, prePrepareMsg)
 		node.Broadcast(node.ClusterName, prePrepareMsg, "/preprepare")
 		LogStage("Pre-prepare", true)
 	}
@@ -430,41 +608,81 @@ func (node *Node) GetReq(reqMsg *consensus.BatchRequestMsg, goOn bool) error {
 	return nil
 }
 
-// GetPrePrepare can be called when the node's CurrentState is nil.
+// verifyPrePrepare 检查已验证签名的 pre-prepare 的批次摘要、批次中的序号以及参与报告
+func (node *Node) verifyPrePrepare(prePrepareMsg *consensus.PrePrepareMsg) error {
+	if prePrepareMsg.RequestMsg == nil {
+		return errors.New("pre-prepare without batch")
+	}
+	jsonMsg, err := json.Marshal(prePrepareMsg.RequestMsg)
+	if err != nil || consensus.Hash(jsonMsg) != prePrepareMsg.Digest {
+		return errors.New("pre-prepare digest mismatch")
+	}
+	if prePrepareMsg.RequestMsg.SequenceID != prePrepareMsg.SequenceID {
+		return errors.New("pre-prepare message contains batch with wrong sequence ID")
+	}
+	for _, reqMsg := range prePrepareMsg.RequestMsg.Requests {
+		if reqMsg == nil || reqMsg.SequenceID != prePrepareMsg.SequenceID {
+			return errors.New("pre-prepare message contains request with wrong sequence ID")
+		}
+	}
+	// 批次中的参与报告执行时会改变信誉分数，投票前先检查
+	return node.verifyReports(prePrepareMsg.RequestMsg, prePrepareMsg.SequenceID)
+}
+
+// GetPrePrepare 为 pre-prepare 中的序号创建共识实例，多个序号可以同时处于共识中
 // Consensus start procedure for normal participants.
 func (node *Node) GetPrePrepare(prePrepareMsg *consensus.PrePrepareMsg, goOn bool) error {
 	LogMsg(prePrepareMsg)
-	node.AcceptRequestTime[prePrepareMsg.SequenceID] = time.Now()
+	acceptTime := time.Now()
 
-	// Create a new state for the new consensus.
-	err := node.createStateForNewConsensus(goOn)
-	if err != nil {
-		return err
+	// 只接受当前视图主节点发出的 pre-prepare
+	if prePrepareMsg.NodeID != node.View.Primary || prePrepareMsg.ViewNumber != node.View.Number {
+		fmt.Printf("非视图 %d 主节点 %s 发送的 pre-prepare，拒绝执行\n", node.View.Number, node.View.Primary)
+		return nil
 	}
-	// fmt.Printf("get Pre\n")
+	// 序号和本地共识轮次一一对应
+	if prePrepareMsg.ViewID != viewIDOfSequence(prePrepareMsg.SequenceID) {
+		return fmt.Errorf("pre-prepare ViewID %d does not match sequence ID %d", prePrepareMsg.ViewID, prePrepareMsg.SequenceID)
+	}
+
+	// 先验证签名和批次，伪造的 pre-prepare 不能创建或覆盖共识实例
 	digest, _ := hex.DecodeString(prePrepareMsg.Digest)
-	if !node.RsaVerySignWithSha256(digest, prePrepareMsg.Sign, node.getPubKey(node.ClusterName, prePrepareMsg.NodeID)) {
-		fmt.Println("节点签名验证失败！,拒绝执行Preprepare")
+	if err := node.RsaVerySignWithSha256(digest, prePrepareMsg.Sign, node.getPubKey(node.ClusterName, prePrepareMsg.NodeID)); err != nil {
+		dropBadSign("pre-prepare", err)
+		return nil
+	}
+	if err := node.verifyPrePrepare(prePrepareMsg); err != nil {
+		node.rejectMsg(prePrepareMsg.NodeID, "pre-prepare", err)
 		return nil
 	}
-	prePareMsg, err := node.CurrentState.PrePrepare(prePrepareMsg)
+
+	// Create a new state for the new consensus.
+	state, err := node.createStateForNewConsensus(prePrepareMsg.SequenceID, goOn)
+	if err != nil {
+		return err
+	}
+	prePareMsg, err := state.PrePrepare(prePrepareMsg)
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
+	// 只为接受的 pre-prepare 记录开始时间，伪造或无效的消息不能覆盖它
+	node.AcceptRequestTime[prePrepareMsg.SequenceID] = acceptTime
+	node.WAL.Append(walPrePrepare, prePrepareMsg)
 
-	if prePareMsg != nil {
+	// 收到合法的 pre-prepare 后启动请求计时器，超时未提交则发起视图切换
+	node.startViewChangeTimer()
+
+	// 观察节点不投票，只根据委员会的 prepare 和 commit 判断批次是否提交
+	if prePareMsg != nil && !node.isObserver() {
 		// Attach node ID to the message 同时对摘要签名
 		prePareMsg.NodeID = node.NodeID
-		signInfo := node.RsaSignWithSha256(digest, node.rsaPrivKey)
-		prePareMsg.Sign = signInfo
+		prePareMsg.ViewNumber = node.View.Number
+		_, prePareMsg.Sign = node.signMsg(prePareMsg)
+		// 记录自己的 prepare 投票，视图切换时作为 prepared 证明的一部分
+		state.MsgLogs.PrepareMsgs[node.NodeID] = prePareMsg
 
 		LogStage("Pre-prepare", true)
-		if node.NodeType == isMaliciousNode {
-			prePareMsg.SequenceID = 0
-			//time.Sleep(100 * time.Millisecond)
-		}
-
 		node.Broadcast(node.ClusterName, prePareMsg, "/prepare")
 		LogStage("Prepare", false)
 	}
@@ -475,31 +693,45 @@ func (node *Node) GetPrePrepare(prePrepareMsg *consensus.PrePrepareMsg, goOn boo
 func (node *Node) GetPrepare(prepareMsg *consensus.VoteMsg) error {
 	LogMsg(prepareMsg)
 
-	digest, _ := hex.DecodeString(prepareMsg.Digest)
-	if !node.RsaVerySignWithSha256(digest, prepareMsg.Sign, node.getPubKey(node.ClusterName, prepareMsg.NodeID)) {
-		fmt.Println("节点签名验证失败！,拒绝执行prepare")
+	state := node.States[prepareMsg.SequenceID]
+	if state == nil || prepareMsg.ViewNumber != node.View.Number {
+		return nil
 	}
-	//主节点是不广播prepare的，所以为自己投一票
-	if node.CurrentState.MsgLogs.PrepareMsgs[node.NodeID] == nil && node.NodeID != node.View.Primary {
-		node.CurrentState.MsgLogs.PrepareMsgs[node.NodeID] = prepareMsg
+
+	// 签名无效的 prepare 直接丢弃，不能计入法定人数
+	if err := node.verifyVote(node.ClusterName, prepareMsg); err != nil {
+		dropBadSign("prepare", err)
+		return nil
 	}
-	commitMsg, err := node.CurrentState.Prepare(prepareMsg)
+	commitMsg, err := state.Prepare(prepareMsg)
 	if err != nil {
-		ErrMessage(prepareMsg)
-		return err
+		node.rejectMsg(prepareMsg.NodeID, "prepare", err)
+		return nil
+	}
+	if commitMsg != nil && node.isObserver() {
+		node.WAL.Append(walPrepared, state.PreparedCert())
+		// 观察节点不投票，只把签名的 commit 发给主节点，主节点把它附加到参与报告中证明本节点在线
+		commitMsg.NodeID = node.NodeID
+		commitMsg.ViewNumber = node.View.Number
+		_, commitMsg.Sign = node.signMsg(commitMsg)
+		if url, ok := node.NodeTable[node.ClusterName][node.View.Primary]; ok {
+			jsonMsg, _ := json.Marshal(commitMsg)
+			node.deliver(url+"/commit", jsonMsg)
+		}
+		return nil
 	}
 	if commitMsg != nil {
 		// Attach node ID to the message 同时对摘要签名
 		commitMsg.NodeID = node.NodeID
-		signInfo := node.RsaSignWithSha256(digest, node.rsaPrivKey)
-		commitMsg.Sign = signInfo
+		commitMsg.ViewNumber = node.View.Number
+		commitMsg.PrepareSenders = prepareSenders(state)
+		_, commitMsg.Sign = node.signMsg(commitMsg)
+		// 记录自己的 commit 投票，committed 证明需要 2f+1 个节点的投票
+		ownCommitMsg := *commitMsg
+		state.MsgLogs.CommitMsgs[node.NodeID] = &ownCommitMsg
+		node.WAL.Append(walPrepared, state.PreparedCert())
 
 		LogStage("Prepare", true)
-		if node.NodeType == isMaliciousNode {
-			commitMsg.SequenceID = 0
-			//time.Sleep(100 * time.Millisecond)
-		}
-
 		node.Broadcast(node.ClusterName, commitMsg, "/commit")
 		LogStage("Commit", false)
 	}
@@ -509,21 +741,27 @@ func (node *Node) GetPrepare(prepareMsg *consensus.VoteMsg) error {
 
 func (node *Node) GetCommit(commitMsg *consensus.VoteMsg) error {
 	// 当节点已经完成Committed阶段后就停止接收其他节点的Committed消息
-	if node.CurrentState.CurrentStage == consensus.Committed {
+	state := node.States[commitMsg.SequenceID]
+	if state == nil || state.CurrentStage == consensus.Committed {
 		return nil
 	}
 
 	LogMsg(commitMsg)
 
-	digest, _ := hex.DecodeString(commitMsg.Digest)
-	if !node.RsaVerySignWithSha256(digest, commitMsg.Sign, node.getPubKey(node.ClusterName, commitMsg.NodeID)) {
-		fmt.Println("节点签名验证失败！,拒绝执行commit")
+	if commitMsg.ViewNumber != node.View.Number {
+		return nil
 	}
 
-	replyMsg, committedMsg, err := node.CurrentState.Commit(commitMsg)
+	// 签名无效的 commit 直接丢弃，不能计入法定人数
+	if err := node.verifyVote(node.ClusterName, commitMsg); err != nil {
+		dropBadSign("commit", err)
+		return nil
+	}
+
+	replyMsg, committedMsg, err := state.Commit(commitMsg)
 	if err != nil {
-		ErrMessage(committedMsg)
-		return err
+		node.rejectMsg(commitMsg.NodeID, "commit", err)
+		return nil
 	}
 	// 达成本地Committed共识
 	if replyMsg != nil {
@@ -538,48 +776,11 @@ func (node *Node) GetCommit(commitMsg *consensus.VoteMsg) error {
 		// Save the last version of committed messages to node.
 		// node.CommittedMsgs = append(node.CommittedMsgs, committedMsg)
 
-		LogStage("Commit", true)
-		fmt.Printf("ViewID :%d 达成本地共识，存入待执行缓存池\n", node.View.ID)
-
-		// Append msg to its logs
-		node.GlobalLog.MsgLogs[node.ClusterName][node.View.ID] = committedMsg
+		LogStage(fmt.Sprintf("Commit (SequenceID:%d)", commitMsg.SequenceID), true)
+		state.CurrentStage = consensus.Committed
+		node.WAL.Append(walCommitted, &walCommit{SequenceID: commitMsg.SequenceID, CommitMsgs: state.CommitCert().CommitMsgs})
 
-		if node.NodeID == node.View.Primary { // 本地共识结束后，主节点将本地达成共识的请求发送至其他集群的主节点
-			fmt.Printf("send consensus to Global\n")
-			// 获取消息摘要
-			msg, err := json.Marshal(committedMsg)
-			if err != nil {
-				return err
-			}
-			digest := consensus.Hash(msg)
-
-			// 节点对消息摘要进行签名
-			digestByte, _ := hex.DecodeString(digest)
-			signInfo := node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
-			// committedMsg.Result = false
-			GlobalShareMsg := new(consensus.GlobalShareMsg)
-			GlobalShareMsg.RequestMsg = committedMsg
-			GlobalShareMsg.NodeID = node.NodeID
-			GlobalShareMsg.Sign = signInfo
-			GlobalShareMsg.Digest = digest
-			GlobalShareMsg.Cluster = node.ClusterName
-			GlobalShareMsg.ViewID = node.View.ID
-
-			Sstart := time.Now()
-			node.ShareLocalConsensus(GlobalShareMsg, "/global")
-			end := time.Since(Sstart)
-
-			file, err := os.OpenFile("PrimaryShareToGlobal.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
-			// 使用fmt.Fprintf格式化写入内容到文件
-			_, err = fmt.Fprintf(file, "NodeNum:%d  PrimaryShareToGlobal Used Time: %s\n", consensus.F*3, end)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
+		if node.NodeID != node.View.Primary {
 			re := regexp.MustCompile(`[0-9]+`)
 			matches := re.FindStringSubmatch(node.NodeID)
 			numberStr := matches[0]                 // 提取到的数字部分作为字符串
@@ -598,45 +799,189 @@ func (node *Node) GetCommit(commitMsg *consensus.VoteMsg) error {
 				}
 			}
 		}
-		node.View.ID++
-		node.CurrentState.CurrentStage = consensus.Committed
 
-		// 达成本地共识，检查能否进行全局共识的排序和执行
-		node.GlobalViewIDLock.Lock()
-		if node.GlobalViewID == commitMsg.ViewID {
-			node.Reply(node.GlobalViewID)
+		// 之前的序号都已提交后才能按顺序进入全局共识
+		return node.commitInOrder()
+	}
+	return nil
+}
+
+// commitInOrder 按序号顺序处理已经达成本地共识的实例，乱序完成的实例要等待之前的序号提交
+func (node *Node) commitInOrder() error {
+	committed := false
+	for {
+		state, ok := node.States[node.CommittedSequenceID+1]
+		if !ok || state.CurrentStage != consensus.Committed {
+			break
 		}
-		node.GlobalViewIDLock.Unlock()
+		committed = true
+		committedMsg := state.MsgLogs.ReqMsg
+		fmt.Printf("ViewID :%d 达成本地共识，存入待执行缓存池\n", node.View.ID)
 
+		// Append msg to its logs
+		node.GlobalLog.Save(node.ClusterName, node.View.ID, committedMsg)
+		node.GlobalLog.SaveCert(node.View.ID, state.CommitCert())
+
+		if node.NodeID == node.View.Primary { // 本地共识结束后，主节点将本地达成共识的请求发送至其他集群的主节点
+			if err := node.shareCommittedMsg(node.View.ID, committedMsg, state.CommitCert().CommitMsgs); err != nil {
+				return err
+			}
+		}
+		node.StatesLock.Lock()
+		node.CommittedSequenceID++
+		node.View.ID++
+		node.StatesLock.Unlock()
+		node.removeForwardedRequests(committedMsg)
 	}
+	if !committed {
+		return nil
+	}
+
+	node.stopViewChangeTimer()
+	// 还有正在共识或转发给主节点但尚未提交的请求，继续计时
+	if !node.readyForNewConsensus() || node.hasForwardedRequests() {
+		node.startViewChangeTimer()
+	}
+
+	// 达成本地共识，检查能否进行全局共识的排序和执行
+	node.GlobalViewIDLock.Lock()
+	node.replyReadyRounds()
+	node.GlobalViewIDLock.Unlock()
 	return nil
 }
 
+// shareCommittedMsg 主节点对本地在轮次 viewID 达成共识的批次签名，连同 2f+1 条 commit 投票发送给其他集群
+func (node *Node) shareCommittedMsg(viewID int64, committedMsg *consensus.BatchRequestMsg, commitMsgs []*consensus.VoteMsg) error {
+	fmt.Printf("send consensus to Global\n")
+	// 获取消息摘要
+	msg, err := json.Marshal(committedMsg)
+	if err != nil {
+		return err
+	}
+	digest := consensus.Hash(msg)
+
+	// 节点对消息摘要进行签名
+	digestByte, _ := hex.DecodeString(digest)
+	signInfo := node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
+	// committedMsg.Result = false
+	GlobalShareMsg := new(consensus.GlobalShareMsg)
+	GlobalShareMsg.RequestMsg = committedMsg
+	GlobalShareMsg.NodeID = node.NodeID
+	GlobalShareMsg.Sign = signInfo
+	GlobalShareMsg.Digest = digest
+	GlobalShareMsg.Cluster = node.ClusterName
+	GlobalShareMsg.ViewID = viewID
+	GlobalShareMsg.ViewNumber = node.View.Number
+	GlobalShareMsg.CommitMsgs = commitMsgs
+
+	Sstart := time.Now()
+	node.ShareLocalConsensus(GlobalShareMsg, "/global")
+	end := time.Since(Sstart)
+
+	file, err := os.OpenFile("PrimaryShareToGlobal.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	// 使用fmt.Fprintf格式化写入内容到文件
+	_, err = fmt.Fprintf(file, "NodeNum:%d  PrimaryShareToGlobal Used Time: %s\n", consensus.F*3, end)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+// replyReadyRounds 依次执行所有已经收到各集群消息的全局轮次，调用时需持有 GlobalViewIDLock
+func (node *Node) replyReadyRounds() {
+	for {
+		if ok, _ := node.Reply(node.GlobalViewID); !ok {
+			return
+		}
+	}
+}
+
 func (node *Node) GetReply(msg *consensus.ReplyMsg) {
 	fmt.Printf("Result: %s by %s\n", msg.Result, msg.NodeID)
 }
 
-func (node *Node) createStateForNewConsensus(goOn bool) error {
-	const viewID = 10000000000 // temporary.
-	// Check if there is an ongoing consensus process.
-	if node.CurrentState.LastSequenceID != -2 {
-		if node.CurrentState.CurrentStage != consensus.Committed && !goOn && node.CurrentState.CurrentStage != consensus.GetRequest {
-			return errors.New("another consensus is ongoing")
-		}
+// createStateForNewConsensus 为序号 sequenceID 创建共识实例，goOn 为 true 时(视图切换)覆盖已有的实例
+func (node *Node) createStateForNewConsensus(sequenceID int64, goOn bool) (*consensus.State, error) {
+	if sequenceID <= node.CommittedSequenceID {
+		return nil, fmt.Errorf("sequence ID %d is already committed", sequenceID)
 	}
-	// Get the last sequence ID
-	var lastSequenceID int64
-	if node.View.ID == viewID {
-		lastSequenceID = -1
-	} else {
-		lastSequenceID = node.GlobalLog.MsgLogs[node.ClusterName][node.View.ID-1].Requests[0].SequenceID
+	if !node.inWatermarks(sequenceID) {
+		return nil, fmt.Errorf("sequence ID %d is out of watermarks", sequenceID)
+	}
+	// Check if there is an ongoing consensus process.
+	if state, ok := node.States[sequenceID]; ok && state.CurrentStage != consensus.Idle && !goOn {
+		return nil, fmt.Errorf("another consensus is ongoing for sequence ID %d", sequenceID)
 	}
 
 	// Create a new state for this new consensus process in the Primary
-	node.CurrentState = consensus.CreateState(node.View.ID, lastSequenceID)
+	state := consensus.CreateState(viewIDOfSequence(sequenceID), sequenceID-1)
+	state.SetWatermarks(node.StableCheckpoint.SequenceID)
+	state.SetCommittee(node.Committee(node.ClusterName, node.View.Number))
+	node.StatesLock.Lock()
+	node.States[sequenceID] = state
+	node.StatesLock.Unlock()
 
 	LogStage("Create the replica status", true)
-	return nil
+	return state, nil
+}
+
+// nextSequenceID 主节点分配的下一个序号，紧接在已提交和正在共识的序号之后
+func (node *Node) nextSequenceID() int64 {
+	next := node.CommittedSequenceID + 1
+	for sequenceID := range node.States {
+		if sequenceID >= next {
+			next = sequenceID + 1
+		}
+	}
+	return next
+}
+
+// readyForNewConsensus 没有尚未提交的共识实例时返回 true
+func (node *Node) readyForNewConsensus() bool {
+	node.StatesLock.RLock()
+	defer node.StatesLock.RUnlock()
+	for _, state := range node.States {
+		if state.CurrentStage != consensus.Committed {
+			return false
+		}
+	}
+	return true
+}
+
+// noopNeeded 其他集群已经提交了本集群下一个序号对应轮次的批次，而本集群没有待处理的请求时，
+// 主节点提出一个空批次，经过本地共识后照常发送给其他集群，全局轮次才能完成
+func (node *Node) noopNeeded() bool {
+	node.MsgBufferLock.ReqMsgsLock.Lock()
+	pending := len(node.MsgBuffer.ReqMsgs)
+	node.MsgBufferLock.ReqMsgsLock.Unlock()
+	if pending > 0 {
+		return false
+	}
+	round := viewIDOfSequence(node.nextSequenceID())
+	for i := 0; i < ClusterNumber; i++ {
+		if Allcluster[i] == node.ClusterName {
+			continue
+		}
+		if _, ok := node.GlobalLog.Get(Allcluster[i], round); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// batchReady 缓存的请求达到 MaxBatchSize 个，或最早的请求已经等待超过 MaxBatchDelay 时可以打包
+func (node *Node) batchReady() bool {
+	node.MsgBufferLock.ReqMsgsLock.Lock()
+	defer node.MsgBufferLock.ReqMsgsLock.Unlock()
+	if len(node.MsgBuffer.ReqMsgs) == 0 {
+		return false
+	}
+	return len(node.MsgBuffer.ReqMsgs) >= consensus.MaxBatchSize ||
+		time.Since(node.MsgBuffer.BatchStartTime) >= consensus.MaxBatchDelay
 }
 
 func (node *Node) dispatchMsg() {
@@ -711,8 +1056,20 @@ func (node *Node) SaveClientRequest(msg interface{}) {
 		//		break
 		//	}
 		//}
+		// 已经执行过的请求直接重发缓存的回复
+		if node.replyCachedRequest(msg.(*consensus.RequestMsg)) {
+			return
+		}
+		// 备份节点收到客户端请求，说明客户端等待超时后进行了广播，转发给主节点并启动请求计时器
+		if node.NodeID != node.View.Primary {
+			node.forwardRequest(msg.(*consensus.RequestMsg))
+			return
+		}
 		//一开始没有进行共识的时候，此时 currentstate 为nil
 		node.MsgBufferLock.ReqMsgsLock.Lock()
+		if len(node.MsgBuffer.ReqMsgs) == 0 {
+			node.MsgBuffer.BatchStartTime = time.Now()
+		}
 		node.MsgBuffer.ReqMsgs = append(node.MsgBuffer.ReqMsgs, msg.(*consensus.RequestMsg))
 		node.MsgBufferLock.ReqMsgsLock.Unlock()
 		fmt.Printf("缓存中收到 %d 条客户端请求\n", len(node.MsgBuffer.ReqMsgs))
@@ -747,11 +1104,50 @@ func (node *Node) routeMsg(msg interface{}) []error {
 			node.MsgBuffer.PrepareMsgs = append(node.MsgBuffer.PrepareMsgs, msg.(*consensus.VoteMsg))
 			node.MsgBufferLock.PrepareMsgsLock.Unlock()
 		} else if msg.(*consensus.VoteMsg).MsgType == consensus.CommitMsg {
+			// 观察节点的 commit 不参与共识，由主节点直接记录
+			if node.recordObserverCommit(msg.(*consensus.VoteMsg)) {
+				return nil
+			}
 			node.MsgBufferLock.CommitMsgsLock.Lock()
 			node.MsgBuffer.CommitMsgs = append(node.MsgBuffer.CommitMsgs, msg.(*consensus.VoteMsg))
 			node.MsgBufferLock.CommitMsgsLock.Unlock()
 		}
 
+	case *consensus.ViewChangeMsg:
+		node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+		node.MsgBuffer.ViewChangeMsgs = append(node.MsgBuffer.ViewChangeMsgs, msg.(*consensus.ViewChangeMsg))
+		node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+	case *consensus.NewViewMsg:
+		node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+		node.MsgBuffer.NewViewMsgs = append(node.MsgBuffer.NewViewMsgs, msg.(*consensus.NewViewMsg))
+		node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+	case *consensus.RemoteViewChangeMsg:
+		node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+		node.MsgBuffer.RemoteViewChangeMsgs = append(node.MsgBuffer.RemoteViewChangeMsgs, msg.(*consensus.RemoteViewChangeMsg))
+		node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+	case *consensus.PrimaryChangeMsg:
+		node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+		node.MsgBuffer.PrimaryChangeMsgs = append(node.MsgBuffer.PrimaryChangeMsgs, msg.(*consensus.PrimaryChangeMsg))
+		node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+	case *consensus.CheckpointMsg:
+		node.MsgBufferLock.CheckpointMsgsLock.Lock()
+		node.MsgBuffer.CheckpointMsgs = append(node.MsgBuffer.CheckpointMsgs, msg.(*consensus.CheckpointMsg))
+		node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+
+	case *consensus.FetchStateMsg:
+		node.MsgBufferLock.CheckpointMsgsLock.Lock()
+		node.MsgBuffer.FetchStateMsgs = append(node.MsgBuffer.FetchStateMsgs, msg.(*consensus.FetchStateMsg))
+		node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+
+	case *consensus.StateTransferMsg:
+		node.MsgBufferLock.CheckpointMsgsLock.Lock()
+		node.MsgBuffer.StateTransferMsgs = append(node.MsgBuffer.StateTransferMsgs, msg.(*consensus.StateTransferMsg))
+		node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+
 		//fmt.Printf("                    Msgbuffer %d %d %d %d\n", len(node.MsgBuffer.ReqMsgs), len(node.MsgBuffer.PrePrepareMsgs), len(node.MsgBuffer.PrepareMsgs), len(node.MsgBuffer.CommitMsgs))
 	}
 
@@ -767,6 +1163,12 @@ func (node *Node) routeMsgWhenAlarmed() []error {
 		lastViewId = node.View.ID
 		lastGlobalId = node.GlobalViewID
 	}
+
+	// 请求计时器和共识实例由 resolveMsg 检查，这里只发出通知
+	select {
+	case node.TimerCheck <- true:
+	default:
+	}
 	//if node.CurrentState.LastSequenceID == -2 || node.CurrentState.CurrentStage == consensus.Committed {
 	//	// Check ReqMsgs, send them.
 	//	if len(node.MsgBuffer.ReqMsgs) != 0 {
@@ -858,14 +1260,15 @@ func (node *Node) resolveGlobalMsg() {
 }
 
 // 出队
-// Dequeue for Request messages
-func (mb *MsgBuffer) DequeueReqMsg() *consensus.RequestMsg {
-	if len(mb.ReqMsgs) == 0 {
-		return nil
-	}
-	msg := mb.ReqMsgs[0]                          // 获取第一个元素
-	mb.ReqMsgs = mb.ReqMsgs[consensus.BatchSize:] // 移除第一个元素
-	return msg
+// Dequeue for Request messages, 最多取出 n 个请求
+func (mb *MsgBuffer) DequeueReqMsgs(n int) []*consensus.RequestMsg {
+	if n > len(mb.ReqMsgs) {
+		n = len(mb.ReqMsgs)
+	}
+	msgs := make([]*consensus.RequestMsg, n)
+	copy(msgs, mb.ReqMsgs[:n])  // 获取前 n 个元素
+	mb.ReqMsgs = mb.ReqMsgs[n:] // 移除前 n 个元素
+	return msgs
 }
 
 // Dequeue for PrePrepare messages
@@ -884,124 +1287,226 @@ func (node *Node) resolveMsg() {
 
 		// Get buffered messages from the dispatcher.
 		switch {
-		case len(node.MsgBuffer.ReqMsgs) >= consensus.BatchSize && (node.CurrentState.LastSequenceID == -2 || node.CurrentState.CurrentStage == consensus.Committed):
+		case len(node.TimerCheck) > 0:
+			<-node.TimerCheck
+			// 检查请求计时器是否超时，本节点是否落后于其他节点，其他集群是否停止发送批次，以及是否需要切换到选举出的主节点
+			node.checkViewChangeTimer()
+			node.checkLagging()
+			node.checkRemoteClusters()
+			node.checkElection()
+		case len(node.MsgBuffer.ViewChangeMsgs) > 0:
+			node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+			msg := node.MsgBuffer.ViewChangeMsgs[0]
+			node.MsgBuffer.ViewChangeMsgs = node.MsgBuffer.ViewChangeMsgs[1:]
+			node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+			err := node.GetViewChange(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case len(node.MsgBuffer.NewViewMsgs) > 0:
+			node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+			msg := node.MsgBuffer.NewViewMsgs[0]
+			node.MsgBuffer.NewViewMsgs = node.MsgBuffer.NewViewMsgs[1:]
+			node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+			err := node.GetNewView(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case len(node.MsgBuffer.RemoteViewChangeMsgs) > 0:
+			node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+			msg := node.MsgBuffer.RemoteViewChangeMsgs[0]
+			node.MsgBuffer.RemoteViewChangeMsgs = node.MsgBuffer.RemoteViewChangeMsgs[1:]
+			node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+			err := node.GetRemoteViewChange(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case len(node.MsgBuffer.PrimaryChangeMsgs) > 0:
+			node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+			msg := node.MsgBuffer.PrimaryChangeMsgs[0]
+			node.MsgBuffer.PrimaryChangeMsgs = node.MsgBuffer.PrimaryChangeMsgs[1:]
+			node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+
+			err := node.GetPrimaryChange(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case len(node.MsgBuffer.CheckpointMsgs) > 0:
+			node.MsgBufferLock.CheckpointMsgsLock.Lock()
+			msg := node.MsgBuffer.CheckpointMsgs[0]
+			node.MsgBuffer.CheckpointMsgs = node.MsgBuffer.CheckpointMsgs[1:]
+			node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+
+			err := node.GetCheckpoint(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case len(node.MsgBuffer.FetchStateMsgs) > 0:
+			node.MsgBufferLock.CheckpointMsgsLock.Lock()
+			msg := node.MsgBuffer.FetchStateMsgs[0]
+			node.MsgBuffer.FetchStateMsgs = node.MsgBuffer.FetchStateMsgs[1:]
+			node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+
+			err := node.GetFetchState(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case len(node.MsgBuffer.StateTransferMsgs) > 0:
+			node.MsgBufferLock.CheckpointMsgsLock.Lock()
+			msg := node.MsgBuffer.StateTransferMsgs[0]
+			node.MsgBuffer.StateTransferMsgs = node.MsgBuffer.StateTransferMsgs[1:]
+			node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+
+			err := node.GetStateTransfer(msg)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case node.ViewChange.IsChanging():
+			// 视图切换期间暂停处理正常的共识消息
+		case node.NodeID == node.View.Primary && node.batchReady() && node.inWatermarks(node.nextSequenceID()):
 			node.MsgBufferLock.ReqMsgsLock.Lock()
-			// 初始化batch并确保它是非nil
-			var batch consensus.BatchRequestMsg
-			const viewID = 10000000000
-			// 逐个赋值到数组中
-			for j := 0; j < consensus.BatchSize; j++ {
-				batch.Requests[j] = node.MsgBuffer.ReqMsgs[j]
+			// 打包前去掉已执行或已在排序中的重复请求
+			node.dropDuplicateRequests()
+			if len(node.MsgBuffer.ReqMsgs) == 0 {
+				node.MsgBufferLock.ReqMsgsLock.Unlock()
+				break
+			}
+			// 按到达顺序取出最多 MaxBatchSize 个请求组成一个批次
+			batch := &consensus.BatchRequestMsg{
+				Requests: node.MsgBuffer.DequeueReqMsgs(consensus.MaxBatchSize),
+			}
+			for _, reqMsg := range batch.Requests {
+				node.ClientTable.Propose(reqMsg)
 			}
-			batch.Timestamp = node.MsgBuffer.ReqMsgs[0].Timestamp
-			batch.ClientID = node.MsgBuffer.ReqMsgs[0].ClientID
+			batch.Timestamp = batch.Requests[0].Timestamp
+			batch.ClientID = batch.Requests[0].ClientID
 			// batch.Send = false
 			// 添加新的批次到批次消息缓存
-			node.MsgBuffer.BatchReqMsgs = append(node.MsgBuffer.BatchReqMsgs, &batch)
+			node.MsgBuffer.BatchReqMsgs[node.nextSequenceID()] = batch
+			// 剩下的请求重新开始计时
+			node.MsgBuffer.BatchStartTime = time.Now()
+			fmt.Printf("打包 %d 条请求，缓存中剩余 %d 条\n", len(batch.Requests), len(node.MsgBuffer.ReqMsgs))
 
-			errs := node.resolveRequestMsg(node.MsgBuffer.BatchReqMsgs[node.View.ID-viewID])
+			errs := node.resolveRequestMsg(batch)
 			if errs != nil {
 				fmt.Println(errs)
 				// TODO: send err to ErrorChannel
 			}
-			node.MsgBuffer.DequeueReqMsg()
 			node.MsgBufferLock.ReqMsgsLock.Unlock()
-		case len(node.MsgBuffer.PrePrepareMsgs) > 0 && (node.CurrentState.LastSequenceID == -2 || node.CurrentState.CurrentStage == consensus.Committed):
-			node.MsgBufferLock.PrePrepareMsgsLock.Lock()
-			errs := node.resolvePrePrepareMsg(node.MsgBuffer.PrePrepareMsgs[0])
-			if errs != nil {
-				fmt.Println(errs)
-				// TODO: send err to ErrorChannel
-			}
-			node.MsgBuffer.DequeuePrePrepareMsg()
-			node.MsgBufferLock.PrePrepareMsgsLock.Unlock()
-		case len(node.MsgBuffer.PrepareMsgs) > 0 && node.CurrentState.CurrentStage == consensus.PrePrepared:
-			node.MsgBufferLock.PrepareMsgsLock.Lock()
-			var keepIndexes []int     // 用于存储需要保留的元素的索引
-			var processIndex int = -1 // 用于存储第一个符合条件的元素的索引，初始化为-1表示未找到
-			// 首先遍历PrepareMsgs，确定哪些元素需要保留，哪个元素需要处理
-			for index, value := range node.MsgBuffer.PrepareMsgs {
-				if value.ViewID < node.View.ID {
-					// 不需要做任何事，因为这个元素将被删除
-				} else if value.ViewID > node.View.ID {
-					keepIndexes = append(keepIndexes, index) // 保留这个元素
-				} else if processIndex == -1 { // 只记录第一个符合条件的元素
-					processIndex = index
-				} else {
-					keepIndexes = append(keepIndexes, index)
-				}
-			}
-			// 如果找到了符合条件的元素，则处理它
-			if processIndex != -1 {
-				errs := node.resolvePrepareMsg(node.MsgBuffer.PrepareMsgs[processIndex])
-				// 将这个元素标记为已处理，不再保留
-				if errs != nil {
-					fmt.Println(errs)
-					// TODO: send err to ErrorChannel
-				}
-			}
-			// 创建一个新的切片来存储保留的元素
-			var newPrepareMsgs []*consensus.VoteMsg // 假设YourMsgType是PrepareMsgs中元素的类型
-			for _, index := range keepIndexes {
-				newPrepareMsgs = append(newPrepareMsgs, node.MsgBuffer.PrepareMsgs[index])
+		case node.NodeID == node.View.Primary && node.inWatermarks(node.nextSequenceID()) && node.noopNeeded():
+			sequenceID := node.nextSequenceID()
+			fmt.Printf("其他集群已经提交轮次 %d，本集群没有请求，提出空批次\n", viewIDOfSequence(sequenceID))
+			batch := &consensus.BatchRequestMsg{Requests: make([]*consensus.RequestMsg, 0)}
+			node.MsgBufferLock.ReqMsgsLock.Lock()
+			node.MsgBuffer.BatchReqMsgs[sequenceID] = batch
+			node.MsgBufferLock.ReqMsgsLock.Unlock()
+
+			if err := node.resolveRequestMsg(batch); err != nil {
+				fmt.Println(err)
 			}
+		case len(node.MsgBuffer.PrePrepareMsgs) > 0 && node.resolveBufferedPrePrepareMsgs():
+		case len(node.MsgBuffer.PrepareMsgs) > 0 && node.resolveBufferedPrepareMsgs():
+		case len(node.MsgBuffer.CommitMsgs) > 0 && node.resolveBufferedCommitMsgs():
+		default:
+
+		}
 
-			// 更新原来的PrepareMsgs为只包含保留元素的新切片
-			node.MsgBuffer.PrepareMsgs = newPrepareMsgs
+	}
+}
 
-			node.MsgBufferLock.PrepareMsgsLock.Unlock()
+// resolveBufferedPrePrepareMsgs 处理缓存中第一个可以开始的 pre-prepare，序号不能跳过尚未开始的序号，
+// 已提交或旧视图的消息被删除，返回是否处理了消息
+func (node *Node) resolveBufferedPrePrepareMsgs() bool {
+	node.MsgBufferLock.PrePrepareMsgsLock.Lock()
+	defer node.MsgBufferLock.PrePrepareMsgsLock.Unlock()
+
+	var keepIndexes []int // 用于存储需要保留的元素的索引
+	var processIndex = -1 // 用于存储第一个符合条件的元素的索引，初始化为-1表示未找到
+	next := node.nextSequenceID()
+	for index, value := range node.MsgBuffer.PrePrepareMsgs {
+		if value.SequenceID <= node.CommittedSequenceID || value.ViewNumber < node.View.Number {
+			// 不需要做任何事，因为这个元素将被删除
+		} else if value.SequenceID > next || value.ViewNumber > node.View.Number {
+			keepIndexes = append(keepIndexes, index) // 保留这个元素，等待之前的序号或新视图
+		} else if processIndex == -1 { // 只记录第一个符合条件的元素
+			processIndex = index
+		} else {
+			keepIndexes = append(keepIndexes, index)
+		}
+	}
+	if processIndex != -1 {
+		errs := node.resolvePrePrepareMsg(node.MsgBuffer.PrePrepareMsgs[processIndex])
+		if errs != nil {
+			fmt.Println(errs)
+			// TODO: send err to ErrorChannel
+		}
+	}
+	var newPrePrepareMsgs []*consensus.PrePrepareMsg
+	for _, index := range keepIndexes {
+		newPrePrepareMsgs = append(newPrePrepareMsgs, node.MsgBuffer.PrePrepareMsgs[index])
+	}
+	processed := processIndex != -1 || len(newPrePrepareMsgs) != len(node.MsgBuffer.PrePrepareMsgs)
+	node.MsgBuffer.PrePrepareMsgs = newPrePrepareMsgs
 
-			//errs := node.resolvePrepareMsg(node.MsgBuffer.PrepareMsgs[0])
-			//if errs != nil {
-			//
-			//	fmt.Println(errs)
-			//
-			//	// TODO: send err to ErrorChannel
-			//}
-			//node.MsgBufferLock.PrepareMsgsLock.Lock()
-			//node.MsgBuffer.DequeuePrepareMsg()
-			//node.MsgBufferLock.PrepareMsgsLock.Unlock()
-		case len(node.MsgBuffer.CommitMsgs) > 0 && (node.CurrentState.CurrentStage == consensus.Prepared):
-			node.MsgBufferLock.CommitMsgsLock.Lock()
-			var keepIndexes []int // 用于存储需要保留的元素的索引
-			var processIndex = -1 // 用于存储第一个符合条件的元素的索引，初始化为-1表示未找到
-			// 首先遍历PrepareMsgs，确定哪些元素需要保留，哪个元素需要处理
-			for index, value := range node.MsgBuffer.CommitMsgs {
-				if value.ViewID < node.View.ID {
-					// 不需要做任何事，因为这个元素将被删除
-				} else if value.ViewID > node.View.ID {
-					keepIndexes = append(keepIndexes, index) // 保留这个元素
-				} else if processIndex == -1 { // 只记录第一个符合条件的元素
-					processIndex = index
-				} else {
-					keepIndexes = append(keepIndexes, index)
-				}
-			}
-			// 如果找到了符合条件的元素，则处理它
-			if processIndex != -1 {
-				errs := node.resolveCommitMsg(node.MsgBuffer.CommitMsgs[processIndex])
-				// 将这个元素标记为已处理，不再保留
-				if errs != nil {
-					fmt.Println(errs)
-					// TODO: send err to ErrorChannel
-				}
-			}
-			// 创建一个新的切片来存储保留的元素
-			var newCommitMsgs []*consensus.VoteMsg // 假设YourMsgType是PrepareMsgs中元素的类型
-			for _, index := range keepIndexes {
-				newCommitMsgs = append(newCommitMsgs, node.MsgBuffer.CommitMsgs[index])
-			}
+	return processed
+}
 
-			// 更新原来的PrepareMsgs为只包含保留元素的新切片
-			node.MsgBuffer.CommitMsgs = newCommitMsgs
+// resolveBufferedPrepareMsgs 处理缓存中第一个对应实例处于 pre-prepared 阶段的 prepare，返回是否处理了消息
+func (node *Node) resolveBufferedPrepareMsgs() bool {
+	node.MsgBufferLock.PrepareMsgsLock.Lock()
+	defer node.MsgBufferLock.PrepareMsgsLock.Unlock()
 
-			node.MsgBufferLock.CommitMsgsLock.Unlock()
+	var processed bool
+	node.MsgBuffer.PrepareMsgs, processed = node.resolveBufferedVoteMsgs(node.MsgBuffer.PrepareMsgs, consensus.PrePrepared, node.resolvePrepareMsg)
+	return processed
+}
 
-		default:
+// resolveBufferedCommitMsgs 处理缓存中第一个对应实例处于 prepared 阶段的 commit，返回是否处理了消息
+func (node *Node) resolveBufferedCommitMsgs() bool {
+	node.MsgBufferLock.CommitMsgsLock.Lock()
+	defer node.MsgBufferLock.CommitMsgsLock.Unlock()
 
-		}
+	var processed bool
+	node.MsgBuffer.CommitMsgs, processed = node.resolveBufferedVoteMsgs(node.MsgBuffer.CommitMsgs, consensus.Prepared, node.resolveCommitMsg)
+	return processed
+}
 
+// resolveBufferedVoteMsgs 从投票缓存中处理第一条对应实例处于 stage 阶段的投票，尚未到达该阶段的投票继续保留，
+// 已提交或旧视图的投票被删除，返回保留的投票以及是否处理了投票
+func (node *Node) resolveBufferedVoteMsgs(msgs []*consensus.VoteMsg, stage consensus.Stage, resolve func(*consensus.VoteMsg) error) ([]*consensus.VoteMsg, bool) {
+	var keepIndexes []int // 用于存储需要保留的元素的索引
+	var processIndex = -1 // 用于存储第一个符合条件的元素的索引，初始化为-1表示未找到
+	for index, value := range msgs {
+		state := node.States[value.SequenceID]
+		if value.SequenceID <= node.CommittedSequenceID || value.ViewNumber < node.View.Number ||
+			(state != nil && state.CurrentStage > stage) {
+			// 不需要做任何事，因为这个元素将被删除
+		} else if state == nil || state.CurrentStage < stage || value.ViewNumber > node.View.Number {
+			keepIndexes = append(keepIndexes, index) // 保留这个元素
+		} else if processIndex == -1 { // 只记录第一个符合条件的元素
+			processIndex = index
+		} else {
+			keepIndexes = append(keepIndexes, index)
+		}
 	}
+	// 如果找到了符合条件的元素，则处理它
+	if processIndex != -1 {
+		errs := resolve(msgs[processIndex])
+		if errs != nil {
+			fmt.Println(errs)
+			// TODO: send err to ErrorChannel
+		}
+	}
+	// 创建一个新的切片来存储保留的元素
+	var newMsgs []*consensus.VoteMsg
+	for _, index := range keepIndexes {
+		newMsgs = append(newMsgs, msgs[index])
+	}
+
+	return newMsgs, processIndex != -1 || len(newMsgs) != len(msgs)
 }
 
 func (node *Node) alarmToDispatcher() {
@@ -1069,8 +1574,8 @@ func (node *Node) GlobalConsensus(msg *consensus.LocalMsg) (*consensus.ReplyMsg,
 	// Print current voting status
 	fmt.Printf("-----Global-Commit-Save For %s----\n", msg.GlobalShareMsg.Cluster)
 
-	// This node executes the requested operation locally and gets the result.
-	result := "Executed"
+	// 这里只把其他集群的请求写入全局日志，请求在 Reply 中按全局顺序由状态机执行
+	result := "Saved"
 
 	// Change the stage to prepared.
 	return &consensus.ReplyMsg{
@@ -1086,30 +1591,33 @@ func (node *Node) GlobalConsensus(msg *consensus.LocalMsg) (*consensus.ReplyMsg,
 // CommitGlobalMsgToLocal 收到本地节点发来的全局共识消息
 func (node *Node) CommitGlobalMsgToLocal(reqMsg *consensus.LocalMsg) error {
 	// LogMsg(reqMsg)
+	if node.knownGlobalShare(reqMsg.GlobalShareMsg) {
+		return nil
+	}
 
 	digest, _ := hex.DecodeString(reqMsg.GlobalShareMsg.Digest)
-	if !node.RsaVerySignWithSha256(digest, reqMsg.Sign, node.getPubKey(node.ClusterName, reqMsg.NodeID)) {
-		fmt.Println("节点签名验证失败！,拒绝执行Global commit")
+	if err := node.RsaVerySignWithSha256(digest, reqMsg.Sign, node.getPubKey(node.ClusterName, reqMsg.NodeID)); err != nil {
+		dropBadSign("转发的全局共识", err)
+		return nil
+	}
+	if err := node.verifyGlobalShare(reqMsg.GlobalShareMsg); err != nil {
+		node.rejectMsg(reqMsg.NodeID, "转发的全局共识", err)
+		return nil
 	}
 
 	// Append msg to its logs
-	node.GlobalLog.MsgLogs[reqMsg.GlobalShareMsg.Cluster][reqMsg.GlobalShareMsg.ViewID] = reqMsg.GlobalShareMsg.RequestMsg
-
-	// 如果是主节点收到其他集群的全局共享消息，需要检查本地有正在进行的共识或收到客户端的消息或者本地共识是否已完成，如果都没有需要发送一个空白消息进行本地共识
-	if node.NodeID == node.View.Primary {
-		// 检查本地有没有正在进行的共识？
-		if node.CurrentState.LastSequenceID == -2 || node.CurrentState.CurrentStage == consensus.Committed {
-			// 检查有没有收到客户端的消息
-			node.MsgBufferLock.ReqMsgsLock.Lock()
-			node.MsgDeliveryLock.Lock()
-			if len(node.MsgBuffer.ReqMsgs) == 0 && len(node.MsgEntrance) == 0 && len(node.MsgDelivery) == 0 {
+	node.WAL.Append(walGlobal, reqMsg.GlobalShareMsg)
+	if !node.GlobalLog.SaveShare(reqMsg.GlobalShareMsg) {
+		return nil
+	}
 
-			}
-			node.MsgDeliveryLock.Unlock()
-			node.MsgBufferLock.ReqMsgsLock.Unlock()
-		}
+	// 其他集群已经完成了本集群尚未完成的轮次，说明本地主节点可能已经故障，启动请求计时器
+	if reqMsg.GlobalShareMsg.ViewID >= node.View.ID {
+		node.startViewChangeTimer()
 	}
 
+	// 本集群没有客户端请求时，主节点由 resolveMsg 提出空批次补上这一轮(见 noopNeeded)
+
 	// GlobalConsensus 会将msg存入MsgLogs中
 	replyMsg, committedMsg, err := node.GlobalConsensus(reqMsg)
 	if err != nil {
@@ -1129,9 +1637,7 @@ func (node *Node) CommitGlobalMsgToLocal(reqMsg *consensus.LocalMsg) error {
 		fmt.Printf("Global stage ID %s %d\n", reqMsg.GlobalShareMsg.Cluster, reqMsg.GlobalShareMsg.ViewID)
 		//fmt.Printf("-----Overall consensus----\n")
 		node.GlobalViewIDLock.Lock()
-		if node.GlobalViewID == reqMsg.GlobalShareMsg.ViewID {
-			node.Reply(node.GlobalViewID)
-		}
+		node.replyReadyRounds()
 		node.GlobalViewIDLock.Unlock()
 		// LogStage("Reply\n", true)
 	}
@@ -1143,15 +1649,32 @@ func (node *Node) CommitGlobalMsgToLocal(reqMsg *consensus.LocalMsg) error {
 func (node *Node) ShareGlobalMsgToLocal(reqMsg *consensus.GlobalShareMsg) error {
 	// LogMsg(reqMsg)
 	// LogStage(fmt.Sprintf("Consensus Process (ViewID:%d)", node.CurrentState.ViewID), false)
+	if node.knownGlobalShare(reqMsg) {
+		return nil
+	}
 	digest, _ := hex.DecodeString(reqMsg.Digest)
-	if !node.RsaVerySignWithSha256(digest, reqMsg.Sign, node.getPubKey(reqMsg.Cluster, reqMsg.NodeID)) {
-		fmt.Println("节点签名验证失败！,拒绝执行Global commit")
+	if _, ok := node.NodeTable[reqMsg.Cluster][reqMsg.NodeID]; !ok || reqMsg.Cluster == node.ClusterName {
+		dropBadSign("全局共识", fmt.Errorf("sender is not a node of another cluster"))
+		return nil
+	}
+	if err := node.RsaVerySignWithSha256(digest, reqMsg.Sign, node.getPubKey(reqMsg.Cluster, reqMsg.NodeID)); err != nil {
+		dropBadSign("全局共识", err)
+		return nil
+	}
+	if err := node.verifyGlobalShare(reqMsg); err != nil {
+		node.rejectMsg(reqMsg.NodeID, "全局共识", err)
+		return nil
 	}
 
-	if reqMsg.NodeID != PrimaryNode[reqMsg.Cluster] {
+	// 发送者必须是该集群在其声明视图下的主节点，且视图不能比已知的更旧
+	node.ClusterViewsLock.Lock()
+	if reqMsg.NodeID != node.PrimaryOf(reqMsg.Cluster, reqMsg.ViewNumber) || reqMsg.ViewNumber < node.ClusterViews[reqMsg.Cluster] {
+		node.ClusterViewsLock.Unlock()
 		fmt.Printf("非 %s 主节点发送的全局共识，拒绝接受", reqMsg.Cluster)
 		return nil
 	}
+	node.ClusterViews[reqMsg.Cluster] = reqMsg.ViewNumber
+	node.ClusterViewsLock.Unlock()
 
 	// 节点对消息摘要进行签名
 	signInfo := node.RsaSignWithSha256(digest, node.rsaPrivKey)
@@ -1167,34 +1690,24 @@ func (node *Node) ShareGlobalMsgToLocal(reqMsg *consensus.GlobalShareMsg) error
 	}
 
 	// 将消息存入log中
-	node.GlobalLog.MsgLogs[reqMsg.Cluster][reqMsg.ViewID] = reqMsg.RequestMsg
+	node.WAL.Append(walGlobal, reqMsg)
+	if !node.GlobalLog.SaveShare(reqMsg) {
+		return nil
+	}
+	if reqMsg.ViewID >= node.View.ID {
+		node.startViewChangeTimer()
+	}
 
+	// 每个接收节点都转发给本集群，其他接收节点故障时本集群也能收到
 	node.Broadcast(node.ClusterName, sendMsg, "/GlobalToLocal")
 	fmt.Printf("----- GlobalToLocal -----\n")
 
-	//如果是主节点收到其他集群的全局共享消息，需要检查本地有正在进行的共识或收到客户端的消息，如果都没有需要发送一个空白消息进行本地共识
-	if node.NodeID == node.View.Primary {
-		// 检查本地有没有正在进行的共识？
-		if node.CurrentState == nil || node.CurrentState.CurrentStage == consensus.Committed {
-			// 检查有没有收到客户端的消息
-			node.MsgBufferLock.ReqMsgsLock.Lock()
-			node.MsgDeliveryLock.Lock()
-			if len(node.MsgBuffer.ReqMsgs) == 0 && len(node.MsgEntrance) == 0 && len(node.MsgDelivery) == 0 {
-				/*
-					_, ok := node.GlobalLog.MsgLogs[node.ClusterName][reqMsg.ViewID]
-					if !ok && reqMsg.RequestMsg.Operation != "Empty" && node.GlobalLog.MsgLogs[reqMsg.Cluster][node.GlobalViewID].Operation != "Empty" {
-						fmt.Printf("Start Empty consensus for ViewID %d in ShareGlobalMsgToLocal\n", reqMsg.ViewID)
-						var msg consensus.RequestMsg
-						msg.ClientID = node.NodeID
-						msg.Operation = "Empty"
-						msg.Timestamp = 0
-						node.MsgEntrance <- &msg
-					}*/
-			}
-			node.MsgDeliveryLock.Unlock()
-			node.MsgBufferLock.ReqMsgsLock.Unlock()
-		}
-	}
+	// 其他接收节点的转发会被当作重复消息丢弃，接收节点自己检查能否执行
+	node.GlobalViewIDLock.Lock()
+	node.replyReadyRounds()
+	node.GlobalViewIDLock.Unlock()
+
+	// 本集群没有客户端请求时，主节点由 resolveMsg 提出空批次补上这一轮(见 noopNeeded)
 
 	return nil
 }
@@ -1243,16 +1756,18 @@ func (node *Node) resolveCommitMsg(msg *consensus.VoteMsg) error {
 
 // 传入节点编号， 获取对应的公钥
 func (node *Node) getPubKey(ClusterName string, nodeID string) []byte {
-	key, err := ioutil.ReadFile("Keys/" + ClusterName + "/" + nodeID + "/" + nodeID + "_RSA_PUB")
+	// 未知节点没有公钥，返回 nil，验证签名时返回错误
+	key, err := ioutil.ReadFile(keyFile(ClusterName, nodeID, "_RSA_PUB"))
 	if err != nil {
-		log.Panic(err)
+		fmt.Println(err)
+		return nil
 	}
 	return key
 }
 
 // 传入节点编号， 获取对应的私钥
 func (node *Node) getPivKey(ClusterName string, nodeID string) []byte {
-	key, err := ioutil.ReadFile("Keys/" + ClusterName + "/" + nodeID + "/" + nodeID + "_RSA_PIV")
+	key, err := ioutil.ReadFile(keyFile(ClusterName, nodeID, "_RSA_PIV"))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -1284,20 +1799,52 @@ func (node *Node) RsaSignWithSha256(data []byte, keyBytes []byte) []byte {
 }
 
 // 签名验证
-func (node *Node) RsaVerySignWithSha256(data, signData, keyBytes []byte) bool {
+func (node *Node) RsaVerySignWithSha256(data, signData, keyBytes []byte) error {
 	block, _ := pem.Decode(keyBytes)
 	if block == nil {
-		panic(errors.New("public key error"))
+		return errors.New("public key error")
 	}
 	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("public key is not an RSA key")
 	}
 
 	hashed := sha256.Sum256(data)
-	err = rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signData)
-	if err != nil {
-		panic(err)
+	return rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, hashed[:], signData)
+}
+
+// validSign 签名有效时返回 true
+func (node *Node) validSign(data, signData, keyBytes []byte) bool {
+	return node.RsaVerySignWithSha256(data, signData, keyBytes) == nil
+}
+
+// rejectMsg 丢弃 sender 发送的签名有效但内容无效的消息，并按发送者统计无效消息的数量。
+// 只统计节点表中的节点，避免无关的 ID 撑大统计表
+func (node *Node) rejectMsg(sender string, kind string, err error) {
+	known := false
+	for _, nodes := range node.NodeTable {
+		if _, ok := nodes[sender]; ok {
+			known = true
+			break
+		}
 	}
-	return true
+	if !known {
+		fmt.Printf("丢弃未知节点 %q 发送的 %s: %s\n", sender, kind, err)
+		return
+	}
+	node.InvalidMsgsLock.Lock()
+	node.InvalidMsgs[sender]++
+	count := node.InvalidMsgs[sender]
+	node.InvalidMsgsLock.Unlock()
+	fmt.Printf("丢弃 %s 发送的 %s: %s (累计 %d 条无效消息)\n", sender, kind, err, count)
+}
+
+// dropBadSign 丢弃签名无效的消息。消息中声明的发送者没有经过认证，可能是其他节点冒充的，
+// 所以日志中不写发送者，也不计入任何节点的无效消息数量
+func dropBadSign(kind string, err error) {
+	fmt.Printf("丢弃签名无效的 %s: %s\n", kind, err)
 }
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"simple_pbft/pbft/consensus"
+	"testing"
+	"time"
+)
+
+// newTestNode 创建集群 N 中视图 0 的备份节点 N2，节点表中的地址不可达，发出的消息都会失败
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+	KeysDir = "../../Keys"
+	node := &Node{
+		NodeID:      "N2",
+		ClusterName: "N",
+		NodeTable: map[string]map[string]string{
+			"N": {"N0": "127.0.0.1:1", "N1": "127.0.0.1:1", "N2": "127.0.0.1:1", "N3": "127.0.0.1:1"},
+		},
+		View:              &View{ID: viewIDOfSequence(1), Primary: "N0"},
+		States:            make(map[int64]*consensus.State),
+		AcceptRequestTime: make(map[int64]time.Time),
+		StableCheckpoint:  &consensus.Checkpoint{},
+		InvalidMsgs:       make(map[string]int),
+		Reputation:        NewReputation(),
+		ViewChange:        NewViewChangeState(),
+		ForwardedReqs:     make(map[string]*consensus.RequestMsg),
+		GlobalLog: &consensus.GlobalLog{
+			MsgLogs: make(map[string]map[int64]*consensus.BatchRequestMsg),
+			Shares:  make(map[string]map[int64]*consensus.GlobalShareMsg),
+			Certs:   make(map[int64]*consensus.CommitCert),
+		},
+	}
+	node.rsaPrivKey = node.getPivKey("N", "N2")
+	return node
+}
+
+// testPrePrepare 返回主节点 N0 为序号 1 签名的 pre-prepare
+func testPrePrepare(node *Node) *consensus.PrePrepareMsg {
+	batch := &consensus.BatchRequestMsg{
+		Requests:   []*consensus.RequestMsg{{Timestamp: 1, ClientID: "Client-N-0", Operation: "PUT k v", SequenceID: 1}},
+		Timestamp:  1,
+		ClientID:   "Client-N-0",
+		SequenceID: 1,
+	}
+	jsonMsg, _ := json.Marshal(batch)
+	msg := &consensus.PrePrepareMsg{
+		ViewID:     viewIDOfSequence(1),
+		SequenceID: 1,
+		Digest:     consensus.Hash(jsonMsg),
+		RequestMsg: batch,
+		NodeID:     "N0",
+	}
+	digestByte, _ := hex.DecodeString(msg.Digest)
+	msg.Sign = node.RsaSignWithSha256(digestByte, node.getPivKey("N", "N0"))
+	return msg
+}
+
+// testVote 返回 signer 用自己的私钥签名、声明由 nodeID 发送的投票
+func testVote(node *Node, msgType consensus.MsgType, digest string, nodeID string, signer string) *consensus.VoteMsg {
+	vote := &consensus.VoteMsg{
+		ViewID:     viewIDOfSequence(1),
+		SequenceID: 1,
+		Digest:     digest,
+		NodeID:     nodeID,
+		MsgType:    msgType,
+	}
+	digestByte, _ := hex.DecodeString(voteDigest(vote))
+	vote.Sign = node.RsaSignWithSha256(digestByte, node.getPivKey("N", signer))
+	return vote
+}
+
+// preparedState 为序号 1 创建已接受 pre-prepare 的共识实例，并记录本节点自己的 prepare
+func preparedState(t *testing.T, node *Node) *consensus.State {
+	t.Helper()
+	prePrepareMsg := testPrePrepare(node)
+	state, err := node.createStateForNewConsensus(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.PrePrepare(prePrepareMsg); err != nil {
+		t.Fatal(err)
+	}
+	state.MsgLogs.PrepareMsgs[node.NodeID] = testVote(node, consensus.PrepareMsg, prePrepareMsg.Digest, "N2", "N2")
+	return state
+}
+
+func TestGetPrepareDropsForgedVotes(t *testing.T) {
+	node := newTestNode(t)
+	state := preparedState(t, node)
+	digest := state.MsgLogs.PrePrepareMsg.Digest
+
+	forged := []*consensus.VoteMsg{
+		testVote(node, consensus.PrepareMsg, digest, "N1", "N3"), // N3 冒充 N1
+		testVote(node, consensus.PrepareMsg, digest, "N3", "N3"),
+		testVote(node, consensus.PrepareMsg, digest, "X9", "N3"), // 节点表中没有的节点
+	}
+	forged[1].Sign = forgedSign(forged[1].Sign)
+	for _, vote := range forged {
+		if err := node.GetPrepare(vote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state.CurrentStage == consensus.Prepared || state.PreparedCert() != nil {
+		t.Fatalf("state prepared with forged prepare votes")
+	}
+	// 签名无效时发送者没有经过认证，不能记到声明的发送者头上
+	if len(node.InvalidMsgs) != 0 {
+		t.Fatalf("invalid message counts %v, expect forged votes not to be counted", node.InvalidMsgs)
+	}
+
+	// N1 正确签名但摘要错误的 prepare 计入 N1 的无效消息
+	wrongDigest := testVote(node, consensus.PrepareMsg, consensus.Hash([]byte("other batch")), "N1", "N1")
+	if err := node.GetPrepare(wrongDigest); err != nil {
+		t.Fatal(err)
+	}
+	if state.CurrentStage == consensus.Prepared || node.InvalidMsgs["N1"] != 1 {
+		t.Fatalf("prepare with wrong digest accepted, invalid message counts %v", node.InvalidMsgs)
+	}
+
+	// 其他委员会成员正确签名的 prepare 使实例进入 prepared
+	if err := node.GetPrepare(testVote(node, consensus.PrepareMsg, digest, "N3", "N3")); err != nil {
+		t.Fatal(err)
+	}
+	if state.CurrentStage != consensus.Prepared || state.PreparedCert() == nil {
+		t.Fatalf("state is not prepared with valid prepare votes")
+	}
+	if state.MsgLogs.CommitMsgs[node.NodeID] == nil {
+		t.Fatalf("node does not vote commit after prepared")
+	}
+}
+
+func TestGetCommitDropsForgedVotes(t *testing.T) {
+	node := newTestNode(t)
+	state := preparedState(t, node)
+	digest := state.MsgLogs.PrePrepareMsg.Digest
+	if err := node.GetPrepare(testVote(node, consensus.PrepareMsg, digest, "N3", "N3")); err != nil {
+		t.Fatal(err)
+	}
+	if state.CurrentStage != consensus.Prepared {
+		t.Fatalf("state is not prepared with valid prepare votes")
+	}
+
+	// N1 的 prepare 签名被改成 commit，N3 的签名是随机字节
+	relabeled := testVote(node, consensus.PrepareMsg, digest, "N1", "N1")
+	relabeled.MsgType = consensus.CommitMsg
+	forged := testVote(node, consensus.CommitMsg, digest, "N3", "N3")
+	forged.Sign = forgedSign(forged.Sign)
+	for _, vote := range []*consensus.VoteMsg{relabeled, forged} {
+		if err := node.GetCommit(vote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state.CurrentStage == consensus.Committed || state.CommitCert() != nil {
+		t.Fatalf("state committed with forged commit votes")
+	}
+	if len(node.InvalidMsgs) != 0 {
+		t.Fatalf("invalid message counts %v, expect forged votes not to be counted", node.InvalidMsgs)
+	}
+
+	// N1 正确签名的 prepare 发到 /commit，签名有效但类型错误，计入 N1 的无效消息
+	if err := node.GetCommit(testVote(node, consensus.PrepareMsg, digest, "N1", "N1")); err != nil {
+		t.Fatal(err)
+	}
+	if state.CurrentStage == consensus.Committed || node.InvalidMsgs["N1"] != 1 {
+		t.Fatalf("prepare accepted as commit, invalid message counts %v", node.InvalidMsgs)
+	}
+
+	// 其他委员会成员正确签名的 commit 使实例进入 committed 并按序提交
+	for _, nodeID := range []string{"N0", "N3"} {
+		if err := node.GetCommit(testVote(node, consensus.CommitMsg, digest, nodeID, nodeID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state.CurrentStage != consensus.Committed || state.CommitCert() == nil {
+		t.Fatalf("state is not committed with valid commit votes")
+	}
+	if node.CommittedSequenceID != 1 {
+		t.Fatalf("committed sequence ID %d, expect 1", node.CommittedSequenceID)
+	}
+}
+
+func TestGetPrePrepareForgedDoesNotCreateState(t *testing.T) {
+	node := newTestNode(t)
+	msg := testPrePrepare(node)
+	msg.Sign = forgedSign(msg.Sign)
+	if err := node.GetPrePrepare(msg, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node.States) != 0 || len(node.AcceptRequestTime) != 0 {
+		t.Fatalf("forged pre-prepare created %d states and %d accept times", len(node.States), len(node.AcceptRequestTime))
+	}
+	if node.nextSequenceID() != 1 || !node.readyForNewConsensus() {
+		t.Fatalf("forged pre-prepare blocks sequence 1")
+	}
+	if len(node.InvalidMsgs) != 0 {
+		t.Fatalf("invalid message counts %v, expect forged pre-prepare not to be counted", node.InvalidMsgs)
+	}
+}
@@ -1,10 +1,8 @@
 package network
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"simple_pbft/pbft/consensus"
 )
 
 func ClientStart(name string) *Client {
@@ -13,8 +11,20 @@ func ClientStart(name string) *Client {
 
 	return client
 }
+
+// ClientStartWithConfig 从配置文件加载集群拓扑和参数后启动集群 name 的客户端
+func ClientStartWithConfig(configPath string, name string) (*Client, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Apply(name); err != nil {
+		return nil, err
+	}
+	return ClientStart(name), nil
+}
 func (client *Client) setRoute() {
-	http.HandleFunc("/reply", client.getReply)
+	http.HandleFunc("/reply", client.submitter.HandleReply)
 
 }
 
@@ -25,14 +35,3 @@ func (client *Client) Start() {
 		return
 	}
 }
-
-func (client *Client) getReply(writer http.ResponseWriter, request *http.Request) {
-	var msg consensus.ReplyMsg
-	err := json.NewDecoder(request.Body).Decode(&msg)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	client.GetReply(msg)
-}
@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/http"
 	"simple_pbft/pbft/consensus"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -38,6 +40,23 @@ func NewServer(nodeID string, clusterName string) *Server {
 	return server
 }
 
+// NewServerWithConfig 从配置文件加载集群拓扑和参数后启动节点 nodeID，节点所在的集群由配置决定
+func NewServerWithConfig(configPath string, nodeID string) (*Server, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	cluster, nodeConfig, ok := config.Node(nodeID)
+	if !ok {
+		return nil, fmt.Errorf("node %s is not configured in %s", nodeID, configPath)
+	}
+	if err := config.Apply(cluster.Name); err != nil {
+		return nil, err
+	}
+	IsMaliciousNode = nodeConfig.ByzantineSpec()
+	return NewServer(nodeID, cluster.Name), nil
+}
+
 func (server *Server) Start() {
 	fmt.Printf("Server %v will be started at %s...\n", server.node.NodeID, server.url)
 	if err := http.ListenAndServe(server.url, nil); err != nil {
@@ -55,6 +74,24 @@ func (server *Server) setRoute() {
 	//接受全局共识消息
 	http.HandleFunc("/global", server.getGlobal)
 	http.HandleFunc("/GlobalToLocal", server.getGlobalToLocal)
+	//视图切换消息
+	http.HandleFunc("/viewchange", server.getViewChange)
+	http.HandleFunc("/newview", server.getNewView)
+	http.HandleFunc("/remoteviewchange", server.getRemoteViewChange)
+	http.HandleFunc("/primarychange", server.getPrimaryChange)
+	http.HandleFunc("/checkpoint", server.getCheckpoint)
+	//状态传输
+	http.HandleFunc("/fetchstate", server.getFetchState)
+	http.HandleFunc("/state", server.getStateTransfer)
+	//状态机只读查询
+	http.HandleFunc("/query", getOnly(server.getQuery))
+	//账本和节点状态只读查询
+	http.HandleFunc("/blocks/", getOnly(server.getBlock))
+	http.HandleFunc("/rounds/", getOnly(server.getRoundOrder))
+	http.HandleFunc("/requests/", getOnly(server.getRequest))
+	http.HandleFunc("/status", getOnly(server.getStatus))
+	http.HandleFunc("/cluster", getOnly(server.getCluster))
+	http.HandleFunc("/scores", getOnly(server.getScores))
 
 }
 
@@ -66,8 +103,7 @@ func (server *Server) getReq(writer http.ResponseWriter, request *http.Request)
 		fmt.Println(err)
 		return
 	}
-	// 保存请求的URL到RequestMsg中
-	msg.URL = request.URL.String()
+	// URL 为客户端接收 reply 的地址，由客户端填写
 	if !flag {
 		start = time.Now()
 		flag = true
@@ -143,6 +179,188 @@ func (server *Server) getGlobalToLocal(writer http.ResponseWriter, request *http
 	server.node.MsgGlobal <- &msg
 }
 
+func (server *Server) getViewChange(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.ViewChangeMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getNewView(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.NewViewMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getRemoteViewChange(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.RemoteViewChangeMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getPrimaryChange(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.PrimaryChangeMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getCheckpoint(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.CheckpointMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getFetchState(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.FetchStateMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getStateTransfer(writer http.ResponseWriter, request *http.Request) {
+	var msg consensus.StateTransferMsg
+	err := json.NewDecoder(request.Body).Decode(&msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	server.node.MsgEntrance <- &msg
+}
+
+func (server *Server) getQuery(writer http.ResponseWriter, request *http.Request) {
+	result, err := server.node.App.Query(request.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer.Write([]byte(result))
+}
+
+// getBlock 返回 /blocks/{height} 对应的区块
+func (server *Server) getBlock(writer http.ResponseWriter, request *http.Request) {
+	height, err := strconv.ParseInt(strings.TrimPrefix(request.URL.Path, "/blocks/"), 10, 64)
+	if err != nil {
+		http.Error(writer, "invalid block height", http.StatusBadRequest)
+		return
+	}
+	block, err := server.node.Ledger.Block(height)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if block == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	writeJSON(writer, block)
+}
+
+// getRoundOrder 返回 /rounds/{height} 对应全局轮次中请求的执行顺序
+func (server *Server) getRoundOrder(writer http.ResponseWriter, request *http.Request) {
+	height, err := strconv.ParseInt(strings.TrimPrefix(request.URL.Path, "/rounds/"), 10, 64)
+	if err != nil {
+		http.Error(writer, "invalid round height", http.StatusBadRequest)
+		return
+	}
+	order, err := server.node.RoundOrder(height)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if order == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	writeJSON(writer, order)
+}
+
+// getRequest 返回 /requests/{client}/{timestamp} 对应请求所在的区块和执行结果
+func (server *Server) getRequest(writer http.ResponseWriter, request *http.Request) {
+	path := strings.TrimPrefix(request.URL.Path, "/requests/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		http.Error(writer, "expect /requests/{client}/{timestamp}", http.StatusBadRequest)
+		return
+	}
+	timestamp, err := strconv.ParseInt(path[i+1:], 10, 64)
+	if err != nil {
+		http.Error(writer, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+	status, err := server.node.RequestStatus(path[:i], timestamp)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	writeJSON(writer, status)
+}
+
+func (server *Server) getStatus(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, server.node.Status())
+}
+
+func (server *Server) getCluster(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, server.node.Cluster())
+}
+
+// getScores 返回各集群节点的信誉分数
+func (server *Server) getScores(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, server.node.ReputationStatus())
+}
+
+// getOnly 只读查询只接受 GET 请求，其他方法返回 405
+func getOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			writer.Header().Set("Allow", http.MethodGet)
+			http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
+
 func send(url string, msg []byte) {
 	buff := bytes.NewBuffer(msg)
 	http.Post("http://"+url, "application/json", buff)
@@ -0,0 +1,259 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"time"
+)
+
+// RemoteViewChangeTimeout 本集群的批次提交后等待其他集群批次的超时时间，比本地视图切换的超时更长，
+// 目标集群的备份节点有机会先自己完成视图切换
+var RemoteViewChangeTimeout = 2 * ViewChangeTimeout
+
+// RemoteViewChangeState 远程视图切换的状态，只由 resolveMsg 访问
+type RemoteViewChangeState struct {
+	Round       int64                                                       // 正在等待的全局轮次
+	Since       time.Time                                                   // 开始等待或上一次发出请求的时间
+	Requested   map[string]int64                                            // cluster - 已经请求替换的最高视图
+	Local       map[remoteViewKey]map[string]*consensus.RemoteViewChangeMsg // 本集群节点的消息，nodeID - msg
+	Sent        map[remoteViewKey]bool                                      // 已经发给目标集群的请求
+	Remote      map[remoteViewKey]map[string]*consensus.RemoteViewChangeMsg // 其他集群发来的请求，nodeID - msg
+	ReshareFrom int64                                                       // 成为新主节点后需要重新发送的最早轮次
+}
+
+// remoteViewKey 本集群的消息以 (目标集群, 轮次, 视图) 区分，其他集群的请求以 (发送集群, 视图) 区分
+type remoteViewKey struct {
+	Cluster    string
+	ViewID     int64
+	ViewNumber int64
+}
+
+func NewRemoteViewChangeState() *RemoteViewChangeState {
+	return &RemoteViewChangeState{
+		Requested: make(map[string]int64),
+		Local:     make(map[remoteViewKey]map[string]*consensus.RemoteViewChangeMsg),
+		Sent:      make(map[remoteViewKey]bool),
+		Remote:    make(map[remoteViewKey]map[string]*consensus.RemoteViewChangeMsg),
+	}
+}
+
+// checkRemoteClusters 由 resolveMsg 在 alarm 到期时调用，本集群的批次已经提交但其他集群的批次迟迟不到时，
+// 在本集群发起对该集群主节点的远程视图切换
+func (node *Node) checkRemoteClusters() {
+	node.GlobalViewIDLock.Lock()
+	round := node.GlobalViewID
+	node.GlobalViewIDLock.Unlock()
+
+	rvc := node.RemoteViewChange
+	for key := range rvc.Local {
+		if key.ViewID < round {
+			delete(rvc.Local, key)
+			delete(rvc.Sent, key)
+		}
+	}
+	// 本集群的批次尚未提交时由本地视图切换负责
+	if _, ok := node.GlobalLog.Get(node.ClusterName, round); !ok {
+		rvc.Round = 0
+		return
+	}
+	if rvc.Round != round {
+		rvc.Round = round
+		rvc.Since = time.Now()
+		return
+	}
+	if time.Since(rvc.Since) < RemoteViewChangeTimeout {
+		return
+	}
+	rvc.Since = time.Now()
+
+	for i := 0; i < ClusterNumber; i++ {
+		cluster := Allcluster[i]
+		if cluster == node.ClusterName {
+			continue
+		}
+		if _, ok := node.GlobalLog.Get(cluster, round); ok {
+			continue
+		}
+		node.ClusterViewsLock.Lock()
+		viewNumber := node.ClusterViews[cluster]
+		node.ClusterViewsLock.Unlock()
+		// 再次超时说明上一次请求之后的主节点仍然没有发送批次
+		if requested, ok := rvc.Requested[cluster]; ok && requested >= viewNumber {
+			viewNumber = requested + 1
+		}
+		fmt.Printf("等待集群 %s 轮次 %d 的批次超时，请求替换其视图 %d 的主节点\n", cluster, round, viewNumber)
+		node.sendRemoteViewChange(cluster, round, viewNumber)
+	}
+}
+
+// sendRemoteViewChange 在本集群广播对目标集群的远程视图切换请求，观察节点不参与
+func (node *Node) sendRemoteViewChange(cluster string, round int64, viewNumber int64) {
+	key := remoteViewKey{Cluster: cluster, ViewID: round, ViewNumber: viewNumber}
+	rvc := node.RemoteViewChange
+	if rvc.Local[key][node.NodeID] != nil || node.isObserver() {
+		return
+	}
+	if viewNumber > rvc.Requested[cluster] {
+		rvc.Requested[cluster] = viewNumber
+	}
+
+	msg := &consensus.RemoteViewChangeMsg{
+		TargetCluster: cluster,
+		ViewID:        round,
+		ViewNumber:    viewNumber,
+		Cluster:       node.ClusterName,
+		NodeID:        node.NodeID,
+	}
+	msg.Digest, msg.Sign = node.signMsg(msg)
+
+	LogStage(fmt.Sprintf("Remote-View-Change (Cluster:%s, View:%d)", cluster, viewNumber), false)
+	node.saveRemoteViewChangeMsg(rvc.Local, key, msg)
+	node.Broadcast(node.ClusterName, msg, "/remoteviewchange")
+	node.tryRemoteViewChange(key)
+}
+
+func (node *Node) saveRemoteViewChangeMsg(msgs map[remoteViewKey]map[string]*consensus.RemoteViewChangeMsg, key remoteViewKey, msg *consensus.RemoteViewChangeMsg) int {
+	if msgs[key] == nil {
+		msgs[key] = make(map[string]*consensus.RemoteViewChangeMsg)
+	}
+	msgs[key][msg.NodeID] = msg
+	return len(msgs[key])
+}
+
+// tryRemoteViewChange 本集群 2f+1 个节点一致认为目标集群没有响应后，把自己的请求发给目标集群的所有节点
+func (node *Node) tryRemoteViewChange(key remoteViewKey) {
+	rvc := node.RemoteViewChange
+	ownMsg := rvc.Local[key][node.NodeID]
+	if rvc.Sent[key] || ownMsg == nil || len(rvc.Local[key]) < 2*clusterF(node.ClusterName)+1 {
+		return
+	}
+	rvc.Sent[key] = true
+	fmt.Printf("本集群一致认为集群 %s 在轮次 %d 没有响应，请求其替换视图 %d 的主节点\n", key.Cluster, key.ViewID, key.ViewNumber)
+	node.Broadcast(key.Cluster, ownMsg, "/remoteviewchange")
+	LogStage(fmt.Sprintf("Remote-View-Change (Cluster:%s, View:%d)", key.Cluster, key.ViewNumber), true)
+}
+
+// GetRemoteViewChange 处理本集群节点的远程视图切换消息，或其他集群要求本集群替换主节点的请求
+func (node *Node) GetRemoteViewChange(msg *consensus.RemoteViewChangeMsg) error {
+	if _, ok := node.NodeTable[msg.Cluster][msg.NodeID]; !ok {
+		return fmt.Errorf("remote view-change from unknown node %s", msg.NodeID)
+	}
+	// 只统计发送者所在集群当前委员会节点的请求
+	view := node.View.Number
+	if msg.Cluster != node.ClusterName {
+		node.ClusterViewsLock.Lock()
+		view = node.ClusterViews[msg.Cluster]
+		node.ClusterViewsLock.Unlock()
+	}
+	if !node.inCommittee(msg.Cluster, view, msg.NodeID) {
+		return fmt.Errorf("remote view-change from %s which is not in the committee of cluster %s", msg.NodeID, msg.Cluster)
+	}
+	if msg.Digest != remoteViewChangeDigest(msg) {
+		return fmt.Errorf("digest of remote view-change from %s mismatch", msg.NodeID)
+	}
+	digestByte, _ := hex.DecodeString(msg.Digest)
+	if err := node.RsaVerySignWithSha256(digestByte, msg.Sign, node.getPubKey(msg.Cluster, msg.NodeID)); err != nil {
+		return fmt.Errorf("signature of remote view-change from %s is invalid: %s", msg.NodeID, err)
+	}
+
+	switch {
+	case msg.Cluster == node.ClusterName && msg.TargetCluster != node.ClusterName:
+		node.getLocalRemoteViewChange(msg)
+	case msg.TargetCluster == node.ClusterName:
+		node.getRemoteViewChangeRequest(msg)
+	default:
+		return fmt.Errorf("remote view-change for cluster %s is not addressed to %s", msg.TargetCluster, node.ClusterName)
+	}
+	return nil
+}
+
+func (node *Node) getLocalRemoteViewChange(msg *consensus.RemoteViewChangeMsg) {
+	key := remoteViewKey{Cluster: msg.TargetCluster, ViewID: msg.ViewID, ViewNumber: msg.ViewNumber}
+	count := node.saveRemoteViewChangeMsg(node.RemoteViewChange.Local, key, msg)
+	fmt.Printf("[Remote-View-Change-Vote]: Cluster %s, ViewID %d, View %d, %d\n", msg.TargetCluster, msg.ViewID, msg.ViewNumber, count)
+
+	// 收到 f+1 个节点的请求，说明至少有一个正常节点超时，本节点同样缺少该批次时跟随
+	if count >= clusterF(node.ClusterName)+1 && node.RemoteViewChange.Local[key][node.NodeID] == nil {
+		if _, ok := node.GlobalLog.Get(msg.TargetCluster, msg.ViewID); !ok {
+			node.sendRemoteViewChange(msg.TargetCluster, msg.ViewID, msg.ViewNumber)
+			return
+		}
+	}
+	node.tryRemoteViewChange(key)
+}
+
+// getRemoteViewChangeRequest 同一个集群的 f+1 个节点请求替换当前主节点时，发起本地视图切换
+func (node *Node) getRemoteViewChangeRequest(msg *consensus.RemoteViewChangeMsg) {
+	// 该视图的主节点已经被替换
+	if msg.ViewNumber < node.View.Number {
+		return
+	}
+	rvc := node.RemoteViewChange
+	key := remoteViewKey{Cluster: msg.Cluster, ViewNumber: msg.ViewNumber}
+	count := node.saveRemoteViewChangeMsg(rvc.Remote, key, msg)
+	fmt.Printf("[Remote-View-Change-Request]: from %s, View %d, %d\n", msg.Cluster, msg.ViewNumber, count)
+	if count < clusterF(msg.Cluster)+1 {
+		return
+	}
+
+	// 新的主节点需要从请求中最早的轮次开始重新发送已提交的批次
+	for _, request := range rvc.Remote[key] {
+		if rvc.ReshareFrom == 0 || request.ViewID < rvc.ReshareFrom {
+			rvc.ReshareFrom = request.ViewID
+		}
+	}
+	for k := range rvc.Remote {
+		if k.ViewNumber < node.View.Number {
+			delete(rvc.Remote, k)
+		}
+	}
+	fmt.Printf("集群 %s 的 %d 个节点请求替换视图 %d 的主节点\n", msg.Cluster, count, msg.ViewNumber)
+	node.startViewChange(node.nextView(msg.ViewNumber))
+}
+
+// reshareCommitted 因远程视图切换成为新的主节点后，把其他集群在等待的已提交批次重新发送给它们
+func (node *Node) reshareCommitted() {
+	from := node.RemoteViewChange.ReshareFrom
+	node.RemoteViewChange.ReshareFrom = 0
+	if from == 0 {
+		return
+	}
+	for viewID := from; viewID < node.View.ID; viewID++ {
+		committedMsg, commitMsgs, ok := node.committedBatch(viewID)
+		if !ok {
+			fmt.Printf("轮次 %d 的批次已经被截断，无法重新发送\n", viewID)
+			continue
+		}
+		if err := node.shareCommittedMsg(viewID, committedMsg, commitMsgs); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// committedBatch 返回本集群在轮次 viewID 提交的批次及其 commit 投票，已经从全局日志中截断的轮次从账本中读取
+func (node *Node) committedBatch(viewID int64) (*consensus.BatchRequestMsg, []*consensus.VoteMsg, bool) {
+	if msg, ok := node.GlobalLog.Get(node.ClusterName, viewID); ok {
+		if cert, ok := node.GlobalLog.GetCert(viewID); ok && cert != nil {
+			return msg, cert.CommitMsgs, true
+		}
+	}
+	block, err := node.Ledger.Block(sequenceOfViewID(viewID))
+	if err != nil || block == nil {
+		return nil, nil, false
+	}
+	for _, batch := range block.Batches {
+		if batch.Cluster == node.ClusterName {
+			return batch.RequestMsg, batch.CommitMsgs, true
+		}
+	}
+	return nil, nil, false
+}
+
+func remoteViewChangeDigest(msg *consensus.RemoteViewChangeMsg) string {
+	unsigned := *msg
+	unsigned.Digest, unsigned.Sign = "", nil
+	jsonMsg, _ := json.Marshal(&unsigned)
+	return consensus.Hash(jsonMsg)
+}
@@ -0,0 +1,189 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ReplyCacheSize 每个客户端最多缓存的回复数量，时间戳低于缓存窗口的请求视为过期请求
+var ReplyCacheSize = 128
+
+// ClientTable 记录每个客户端已执行请求的回复，保证同一请求 (ClientID, Timestamp) 只执行一次
+type ClientTable struct {
+	Clients map[string]*ClientRecord // clientID - record
+	// 主节点已经分配序号但尚未执行的请求，避免客户端重传的请求被再次排序
+	Proposed map[string]bool // clientID-timestamp
+	Lock     sync.Mutex
+}
+
+type ClientRecord struct {
+	Replies    map[int64]*consensus.ReplyMsg // timestamp - reply
+	Timestamps []int64                       // 缓存中回复的时间戳，升序
+	Evicted    int64                         // 已淘汰回复的最大时间戳，不超过它的请求都已执行
+}
+
+func NewClientTable() *ClientTable {
+	return &ClientTable{
+		Clients:  make(map[string]*ClientRecord),
+		Proposed: make(map[string]bool),
+	}
+}
+
+// Lookup 返回请求是否已经执行过，以及缓存中的回复，已被淘汰的过期请求返回 nil
+func (table *ClientTable) Lookup(reqMsg *consensus.RequestMsg) (*consensus.ReplyMsg, bool) {
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	record, ok := table.Clients[reqMsg.ClientID]
+	if !ok {
+		return nil, false
+	}
+	if reply, ok := record.Replies[reqMsg.Timestamp]; ok {
+		return reply, true
+	}
+	return nil, reqMsg.Timestamp <= record.Evicted
+}
+
+// Save 缓存请求的执行结果，超过 ReplyCacheSize 时淘汰时间戳最小的回复
+func (table *ClientTable) Save(reply *consensus.ReplyMsg) {
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	record, ok := table.Clients[reply.ClientID]
+	if !ok {
+		record = &ClientRecord{Replies: make(map[int64]*consensus.ReplyMsg)}
+		table.Clients[reply.ClientID] = record
+	}
+	delete(table.Proposed, reply.ClientID+"-"+strconv.FormatInt(reply.Timestamp, 10))
+
+	i := sort.Search(len(record.Timestamps), func(i int) bool { return record.Timestamps[i] >= reply.Timestamp })
+	record.Timestamps = append(record.Timestamps, 0)
+	copy(record.Timestamps[i+1:], record.Timestamps[i:])
+	record.Timestamps[i] = reply.Timestamp
+	record.Replies[reply.Timestamp] = reply
+
+	for len(record.Timestamps) > ReplyCacheSize {
+		oldest := record.Timestamps[0]
+		record.Timestamps = record.Timestamps[1:]
+		delete(record.Replies, oldest)
+		if oldest > record.Evicted {
+			record.Evicted = oldest
+		}
+	}
+}
+
+// Propose 标记请求已经被主节点分配序号，请求已经在排序中时返回 false
+func (table *ClientTable) Propose(reqMsg *consensus.RequestMsg) bool {
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	key := requestKey(reqMsg)
+	if table.Proposed[key] {
+		return false
+	}
+	table.Proposed[key] = true
+	return true
+}
+
+// ResetProposed 视图切换后旧视图中未提交的请求需要重新排序
+func (table *ClientTable) ResetProposed() {
+	table.Lock.Lock()
+	table.Proposed = make(map[string]bool)
+	table.Lock.Unlock()
+}
+
+// Snapshot 序列化所有客户端的回复缓存，作为状态快照的一部分
+func (table *ClientTable) Snapshot() ([]byte, error) {
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	return json.Marshal(table.Clients)
+}
+
+// Restore 用快照替换回复缓存，正在排序的请求需要重新排序
+func (table *ClientTable) Restore(snapshot []byte) error {
+	clients := make(map[string]*ClientRecord)
+	if err := json.Unmarshal(snapshot, &clients); err != nil {
+		return err
+	}
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	table.Clients = clients
+	table.Proposed = make(map[string]bool)
+	return nil
+}
+
+// replyCachedRequest 请求已经执行过时重发缓存的回复并返回 true，过期请求直接丢弃
+func (node *Node) replyCachedRequest(reqMsg *consensus.RequestMsg) bool {
+	reply, executed := node.ClientTable.Lookup(reqMsg)
+	if !executed {
+		return false
+	}
+	if reply == nil {
+		fmt.Printf("丢弃过期的客户端请求 %s\n", requestKey(reqMsg))
+		return true
+	}
+	fmt.Printf("客户端请求 %s 已执行，重发缓存的回复\n", requestKey(reqMsg))
+	go node.sendReply(reply, reqMsg.URL)
+	return true
+}
+
+// dropDuplicateRequests 打包前删除缓存中已执行、正在排序或重复的请求，调用时需持有 ReqMsgsLock
+func (node *Node) dropDuplicateRequests() {
+	reqMsgs := make([]*consensus.RequestMsg, 0, len(node.MsgBuffer.ReqMsgs))
+	seen := make(map[string]bool)
+	for _, reqMsg := range node.MsgBuffer.ReqMsgs {
+		key := requestKey(reqMsg)
+		if seen[key] || node.replyCachedRequest(reqMsg) {
+			continue
+		}
+		node.ClientTable.Lock.Lock()
+		proposed := node.ClientTable.Proposed[key]
+		node.ClientTable.Lock.Unlock()
+		if proposed {
+			continue
+		}
+		seen[key] = true
+		reqMsgs = append(reqMsgs, reqMsg)
+	}
+	node.MsgBuffer.ReqMsgs = reqMsgs
+}
+
+// executeRequest 由状态机执行请求并缓存结果，已执行过的请求直接返回缓存的回复而不再执行
+func (node *Node) executeRequest(reqMsg *consensus.RequestMsg) *consensus.ReplyMsg {
+	if reply, executed := node.ClientTable.Lookup(reqMsg); executed {
+		fmt.Printf("客户端请求 %s 已执行，不再重复执行\n", requestKey(reqMsg))
+		return reply
+	}
+
+	reply := &consensus.ReplyMsg{
+		Timestamp: reqMsg.Timestamp,
+		ClientID:  reqMsg.ClientID,
+		Result:    node.App.Execute(reqMsg),
+	}
+	node.ClientTable.Save(reply)
+	return reply
+}
+
+// sendReply 以当前视图和本节点的身份把回复发给客户端
+func (node *Node) sendReply(reply *consensus.ReplyMsg, url string) {
+	// 观察节点不回复客户端，客户端只统计委员会节点的回复
+	if node.isObserver() {
+		return
+	}
+	replyMsg := *reply
+	replyMsg.ViewID = node.View.Number
+	replyMsg.NodeID = node.NodeID
+	replyMsg.Primary = node.View.Primary
+
+	jsonMsg, err := json.Marshal(&replyMsg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if url == "" {
+		url = ClientURL[node.ClusterName]
+	}
+	send(url+"/reply", jsonMsg)
+	fmt.Printf("\nReply to Client!\n")
+}
@@ -0,0 +1,456 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 信誉分数的取值范围和每次调整的幅度
+const (
+	InitialScore = 70
+	MaxScore     = 100
+
+	commitReward        = 1  // 出现在 commit 证明中
+	prepareReward       = 1  // 至少 f+1 条 commit 投票确认收到了它的 prepare，主节点以 pre-prepare 代替
+	absencePenalty      = 2  // 不在 commit 证明中，也没有任何 commit 投票收到它的 prepare
+	timeoutPenalty      = 10 // 因超时被视图切换替换的主节点
+	misbehaviourPenalty = 20 // 没有 prepared 证明就发送 commit，或者列出了不属于本集群的 prepare 发送者
+)
+
+// MaxReportsPerBatch 主节点在一个批次中最多附加的参与报告数量
+var MaxReportsPerBatch = consensus.CheckpointPeriod
+
+// Reputation 各集群节点的信誉分数。分数只在执行全局轮次时根据批次中附带的参与报告更新，
+// 所有节点按相同的顺序执行相同的报告，因此各节点的分数一致
+type Reputation struct {
+	Scores   map[string]map[string]uint8 `json:"scores"`   // cluster - nodeID - score
+	Reported map[string]int64            `json:"reported"` // cluster - 已经计入分数的最高序号
+	Views    map[string]int64            `json:"views"`    // cluster - 报告中出现过的最高视图
+	// 每个纪元选举出的节点排名，epoch - cluster - 按分数从高到低排列的节点
+	Elections map[int64]map[string][]string `json:"elections"`
+	Epoch     int64                         `json:"epoch"` // 最近一次选举的纪元
+	// cluster - nodeID - 报告中该节点签名有效的 commit 所在的最高序号，选举时据此判断节点是否在线
+	Seen map[string]map[string]int64 `json:"seen"`
+	Lock sync.Mutex                  `json:"-"`
+
+	// 主节点已经附加到提案中的最高序号及当时的视图，只由 resolveMsg 访问
+	attached     int64
+	attachedView int64
+	// 主节点收到的观察节点的 commit，sequenceID - nodeID - vote，附加到对应序号的参与报告中
+	observed map[int64]map[string]*consensus.VoteMsg
+}
+
+func NewReputation() *Reputation {
+	return &Reputation{
+		Scores:   make(map[string]map[string]uint8),
+		Reported: make(map[string]int64),
+		Views:    make(map[string]int64),
+
+		Elections: make(map[int64]map[string][]string),
+		Seen:      make(map[string]map[string]int64),
+		observed:  make(map[int64]map[string]*consensus.VoteMsg),
+	}
+}
+
+// score 返回节点的分数，没有记录的节点为初始分数，调用时需持有 Lock
+func (rep *Reputation) score(cluster string, nodeID string) uint8 {
+	if score, ok := rep.Scores[cluster][nodeID]; ok {
+		return score
+	}
+	return InitialScore
+}
+
+// adjust 调整节点的分数并限制在 0 到 MaxScore 之间，调用时需持有 Lock
+func (rep *Reputation) adjust(cluster string, nodeID string, delta int) {
+	score := int(rep.score(cluster, nodeID)) + delta
+	if score < 0 {
+		score = 0
+	}
+	if score > MaxScore {
+		score = MaxScore
+	}
+	if rep.Scores[cluster] == nil {
+		rep.Scores[cluster] = make(map[string]uint8)
+	}
+	rep.Scores[cluster][nodeID] = uint8(score)
+}
+
+// Score 返回节点当前的信誉分数
+func (rep *Reputation) Score(cluster string, nodeID string) uint8 {
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	return rep.score(cluster, nodeID)
+}
+
+// Snapshot 返回信誉分数的快照，与状态机快照一起用于状态传输
+func (rep *Reputation) Snapshot() ([]byte, error) {
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	return json.Marshal(rep)
+}
+
+// Restore 用快照替换信誉分数，旧快照中没有分数时恢复为初始状态
+func (rep *Reputation) Restore(snapshot []byte) error {
+	restored := NewReputation()
+	if len(snapshot) > 0 {
+		if err := json.Unmarshal(snapshot, restored); err != nil {
+			return err
+		}
+	}
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	rep.Scores = restored.Scores
+	rep.Reported = restored.Reported
+	rep.Views = restored.Views
+	rep.Elections = restored.Elections
+	if rep.Elections == nil {
+		rep.Elections = make(map[int64]map[string][]string)
+	}
+	rep.Epoch = restored.Epoch
+	rep.Seen = restored.Seen
+	if rep.Seen == nil {
+		rep.Seen = make(map[string]map[string]int64)
+	}
+	return nil
+}
+
+// see 记录节点 nodeID 在序号 sequenceID 的报告中出现，调用时需持有 Lock
+func (rep *Reputation) see(cluster string, nodeID string, sequenceID int64) {
+	if rep.Seen[cluster] == nil {
+		rep.Seen[cluster] = make(map[string]int64)
+	}
+	if sequenceID > rep.Seen[cluster][nodeID] {
+		rep.Seen[cluster][nodeID] = sequenceID
+	}
+}
+
+// live 节点在序号 sequenceID 之前的一个纪元内出现在报告中，调用时需持有 Lock
+func (rep *Reputation) live(cluster string, nodeID string, sequenceID int64) bool {
+	seen, ok := rep.Seen[cluster][nodeID]
+	return ok && seen > sequenceID-EpochLength
+}
+
+// clusterMembers 返回集群中编号最小的 3f+1 个节点，即纪元 0 的委员会
+func clusterMembers(cluster string) []string {
+	n := 3*clusterF(cluster) + 1
+	members := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		members = append(members, cluster+strconv.Itoa(i))
+	}
+	return members
+}
+
+// prepareSenders 返回实例中发送过 prepare 的节点，commit 消息携带这个列表
+func prepareSenders(state *consensus.State) []string {
+	senders := make([]string, 0, len(state.MsgLogs.PrepareMsgs))
+	for nodeID := range state.MsgLogs.PrepareMsgs {
+		senders = append(senders, nodeID)
+	}
+	sort.Strings(senders)
+	return senders
+}
+
+// attachReports 主节点提出新批次前，把本集群已提交但尚未计入分数的序号的 commit 证明附加到批次中
+func (node *Node) attachReports(batch *consensus.BatchRequestMsg) {
+	rep := node.Reputation
+	rep.Lock.Lock()
+	from := rep.Reported[node.ClusterName]
+	rep.Lock.Unlock()
+	// 上一个视图中附加的报告所在的批次可能没有提交
+	if rep.attachedView == node.View.Number && rep.attached > from {
+		from = rep.attached
+	}
+	rep.attachedView = node.View.Number
+
+	for sequenceID := from + 1; sequenceID <= node.CommittedSequenceID && len(batch.Reports) < MaxReportsPerBatch; sequenceID++ {
+		cert, ok := node.GlobalLog.GetCert(viewIDOfSequence(sequenceID))
+		if !ok || cert == nil || cert.PrePrepareMsg == nil {
+			continue
+		}
+		batch.Reports = append(batch.Reports, &consensus.ParticipationReport{
+			SequenceID: sequenceID,
+			ViewID:     cert.PrePrepareMsg.ViewID,
+			ViewNumber: cert.PrePrepareMsg.ViewNumber,
+			Digest:     cert.PrePrepareMsg.Digest,
+			CommitMsgs: cert.CommitMsgs,
+
+			ObserverMsgs: node.takeObserverCommits(sequenceID),
+		})
+		rep.attached = sequenceID
+	}
+}
+
+// recordObserverCommit 主节点记录观察节点在准备好后发来的 commit，附加到该序号的参与报告中证明观察节点在线。
+// 发送者属于所在视图的委员会，或者本节点还不知道该视图的委员会时返回 false，由正常的 commit 流程处理
+func (node *Node) recordObserverCommit(vote *consensus.VoteMsg) bool {
+	committee := node.Committee(node.ClusterName, vote.ViewNumber)
+	if len(committee) == 0 {
+		return false
+	}
+	for _, member := range committee {
+		if member == vote.NodeID {
+			return false
+		}
+	}
+	if _, ok := node.NodeTable[node.ClusterName][vote.NodeID]; !ok {
+		return false
+	}
+	if node.PrimaryOf(node.ClusterName, vote.ViewNumber) != node.NodeID {
+		return true
+	}
+	if err := node.verifyVote(node.ClusterName, vote); err != nil {
+		dropBadSign("observer commit", err)
+		return true
+	}
+
+	rep := node.Reputation
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	reported := rep.Reported[node.ClusterName]
+	if vote.SequenceID <= reported || vote.SequenceID > reported+2*consensus.WatermarkWindow {
+		return true
+	}
+	if rep.observed[vote.SequenceID] == nil {
+		rep.observed[vote.SequenceID] = make(map[string]*consensus.VoteMsg)
+	}
+	rep.observed[vote.SequenceID][vote.NodeID] = vote
+	return true
+}
+
+// takeObserverCommits 取出序号 sequenceID 的观察节点 commit，同时丢弃更早序号中没有附加的部分
+func (node *Node) takeObserverCommits(sequenceID int64) []*consensus.VoteMsg {
+	rep := node.Reputation
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	votes := make([]*consensus.VoteMsg, 0, len(rep.observed[sequenceID]))
+	for _, vote := range rep.observed[sequenceID] {
+		votes = append(votes, vote)
+	}
+	sort.Slice(votes, func(a, b int) bool { return votes[a].NodeID < votes[b].NodeID })
+	for seq := range rep.observed {
+		if seq <= sequenceID {
+			delete(rep.observed, seq)
+		}
+	}
+	return votes
+}
+
+// observerVoters 返回报告中签名有效的观察节点 commit 的发送者，这些节点不属于报告所在视图的委员会
+func (node *Node) observerVoters(cluster string, report *consensus.ParticipationReport) []string {
+	observers := make([]string, 0, len(report.ObserverMsgs))
+	for nodeID, vote := range node.signedCommits(cluster, report.Digest, report.ViewID, report.ObserverMsgs, false) {
+		if vote.ViewNumber == report.ViewNumber {
+			observers = append(observers, nodeID)
+		}
+	}
+	return observers
+}
+
+// applyReports 执行集群 cluster 的批次时调用，依次把其中的参与报告计入分数，调用时需持有 GlobalViewIDLock
+func (node *Node) applyReports(cluster string, batch *consensus.BatchRequestMsg) {
+	for _, report := range batch.Reports {
+		if err := node.applyReport(cluster, report); err != nil {
+			fmt.Printf("忽略集群 %s 序号 %d 的参与报告: %s\n", cluster, report.SequenceID, err)
+		}
+	}
+}
+
+// verifyReports 备份节点收到序号为 sequenceID 的 pre-prepare 时检查批次中的参与报告，
+// 报告必须按序号递增、位于该序号之前，并且每份都带有 2f+1 条有效的 commit 投票
+func (node *Node) verifyReports(batch *consensus.BatchRequestMsg, sequenceID int64) error {
+	if len(batch.Reports) > MaxReportsPerBatch {
+		return fmt.Errorf("batch carries %d reports, at most %d", len(batch.Reports), MaxReportsPerBatch)
+	}
+	var last int64
+	for _, report := range batch.Reports {
+		if report == nil || report.SequenceID <= last || report.SequenceID >= sequenceID {
+			return fmt.Errorf("report out of order in batch of sequence %d", sequenceID)
+		}
+		last = report.SequenceID
+		if len(report.ObserverMsgs) > len(node.clusterNodes(node.ClusterName)) {
+			return fmt.Errorf("report of sequence %d carries too many observer commits", report.SequenceID)
+		}
+		if _, err := node.reportVoters(node.ClusterName, report); err != nil {
+			return fmt.Errorf("report of sequence %d: %s", report.SequenceID, err)
+		}
+	}
+	return nil
+}
+
+// reportVoters 返回报告中签名有效的 commit 投票。投票的视图必须与报告声明的视图相同，
+// 否则主节点可以抬高报告的视图，让中间视图的主节点被当作超时扣分
+func (node *Node) reportVoters(cluster string, report *consensus.ParticipationReport) (map[string]*consensus.VoteMsg, error) {
+	if report.ViewID != viewIDOfSequence(report.SequenceID) {
+		return nil, fmt.Errorf("round %d does not match sequence %d", report.ViewID, report.SequenceID)
+	}
+	votes := node.commitVoters(cluster, report.Digest, report.ViewID, report.CommitMsgs)
+	for voter, vote := range votes {
+		if vote.ViewNumber != report.ViewNumber {
+			delete(votes, voter)
+		}
+	}
+	if len(votes) < 2*clusterF(cluster)+1 {
+		return nil, fmt.Errorf("report does not contain 2f+1 valid commit votes in view %d", report.ViewNumber)
+	}
+	return votes, nil
+}
+
+// applyReport 根据一份参与报告调整集群 cluster 中节点的分数。报告中的内容都已经随批次达成共识，
+// 这里只使用签名有效的 commit 投票，因此所有节点得到相同的结果
+func (node *Node) applyReport(cluster string, report *consensus.ParticipationReport) error {
+	// commitVoters 需要查询委员会，在加锁之前调用
+	votes, err := node.reportVoters(cluster, report)
+	if err != nil {
+		return err
+	}
+	observers := node.observerVoters(cluster, report)
+
+	rep := node.Reputation
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	if report.SequenceID <= rep.Reported[cluster] {
+		return nil
+	}
+	f := clusterF(cluster)
+	rep.Reported[cluster] = report.SequenceID
+	for voter := range votes {
+		rep.see(cluster, voter, report.SequenceID)
+	}
+	for _, observer := range observers {
+		rep.see(cluster, observer, report.SequenceID)
+	}
+
+	// 报告中的视图比之前高，说明中间每个视图的主节点都因超时被替换。进入新纪元的视图跳跃不是超时，
+	// 只计算与报告处于同一纪元的视图
+	from := rep.Views[cluster]
+	if first := report.ViewNumber / ViewsPerEpoch * ViewsPerEpoch; from < first {
+		from = first
+	}
+	for view := from; view < report.ViewNumber; view++ {
+		rep.adjust(cluster, node.primaryOf(cluster, view), -timeoutPenalty)
+	}
+	if report.ViewNumber > rep.Views[cluster] {
+		rep.Views[cluster] = report.ViewNumber
+	}
+
+	// 只有报告所在视图的委员会节点参与评分，观察节点的分数保持不变
+	members := node.committeeOf(cluster, report.ViewNumber)
+	isMember := make(map[string]bool, len(members))
+	for _, member := range members {
+		isMember[member] = true
+	}
+	witnesses := make(map[string]int) // nodeID - 确认收到其 prepare 的 commit 投票数
+	misbehaved := make(map[string]bool)
+	for voter, vote := range votes {
+		senders := make(map[string]bool)
+		for _, sender := range vote.PrepareSenders {
+			if !isMember[sender] {
+				misbehaved[voter] = true
+				continue
+			}
+			senders[sender] = true
+		}
+		// prepared 需要 2f 条 prepare 消息
+		if len(senders) < 2*f {
+			misbehaved[voter] = true
+		}
+		for sender := range senders {
+			witnesses[sender]++
+		}
+	}
+
+	primary := node.primaryOf(cluster, report.ViewNumber)
+	for _, member := range members {
+		_, committed := votes[member]
+		prepared := witnesses[member] >= f+1 || member == primary
+		delta := 0
+		if committed {
+			delta += commitReward
+		}
+		if prepared {
+			delta += prepareReward
+		}
+		if !committed && witnesses[member] == 0 && member != primary {
+			delta -= absencePenalty
+		}
+		if misbehaved[member] {
+			delta -= misbehaviourPenalty
+		}
+		rep.adjust(cluster, member, delta)
+	}
+	return nil
+}
+
+// commitVoters 返回 votes 中 cluster 投票所在视图的委员会节点对轮次 viewID 中摘要为 digest 的批次签名有效的 commit 投票，nodeID - vote
+func (node *Node) commitVoters(cluster string, digest string, viewID int64, votes []*consensus.VoteMsg) map[string]*consensus.VoteMsg {
+	return node.signedCommits(cluster, digest, viewID, votes, true)
+}
+
+// signedCommits 与 commitVoters 相同，member 为 false 时只保留不属于投票所在视图委员会的节点，即观察节点
+func (node *Node) signedCommits(cluster string, digest string, viewID int64, votes []*consensus.VoteMsg, member bool) map[string]*consensus.VoteMsg {
+	voters := make(map[string]*consensus.VoteMsg)
+	for _, vote := range votes {
+		if vote.MsgType != consensus.CommitMsg || vote.Digest != digest || vote.ViewID != viewID {
+			continue
+		}
+		if vote.SequenceID != sequenceOfViewID(viewID) {
+			continue
+		}
+		if _, ok := node.NodeTable[cluster][vote.NodeID]; !ok {
+			continue
+		}
+		if _, ok := voters[vote.NodeID]; ok {
+			continue
+		}
+		if node.inCommittee(cluster, vote.ViewNumber, vote.NodeID) != member {
+			continue
+		}
+		if node.verifyVote(cluster, vote) != nil {
+			continue
+		}
+		voters[vote.NodeID] = vote
+	}
+	return voters
+}
+
+// ReputationStatus 各集群节点的信誉分数，由 /scores 返回
+type ReputationStatus struct {
+	Scores    map[string]map[string]uint8 `json:"scores"`
+	Reported  map[string]int64            `json:"reported"`
+	Views     map[string]int64            `json:"views"`
+	Epoch     int64                       `json:"epoch"`
+	Elected   map[string]string           `json:"elected"`   // cluster - 最近一次选举排名第一的节点
+	Committee map[string][]string         `json:"committee"` // cluster - 最近一次选举的委员会
+}
+
+// ReputationStatus 返回所有集群节点(包括观察节点)的当前分数和最近一次选举的结果
+func (node *Node) ReputationStatus() *ReputationStatus {
+	rep := node.Reputation
+	rep.Lock.Lock()
+	defer rep.Lock.Unlock()
+	status := &ReputationStatus{
+		Scores:   make(map[string]map[string]uint8),
+		Reported: make(map[string]int64),
+		Views:    make(map[string]int64),
+		Epoch:    rep.Epoch,
+		Elected:  make(map[string]string),
+
+		Committee: make(map[string][]string),
+	}
+	for i := 0; i < ClusterNumber; i++ {
+		cluster := Allcluster[i]
+		status.Scores[cluster] = make(map[string]uint8)
+		for _, nodeID := range node.clusterNodes(cluster) {
+			status.Scores[cluster][nodeID] = rep.score(cluster, nodeID)
+		}
+		status.Reported[cluster] = rep.Reported[cluster]
+		status.Views[cluster] = rep.Views[cluster]
+		status.Elected[cluster] = node.primaryOf(cluster, rep.Epoch*ViewsPerEpoch)
+		status.Committee[cluster] = node.committeeOf(cluster, rep.Epoch*ViewsPerEpoch)
+	}
+	return status
+}
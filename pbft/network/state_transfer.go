@@ -0,0 +1,391 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"sort"
+)
+
+// StateTransfer 记录上一次 alarm 时的进度，连续两次检查都没有任何进展、且其他节点已经领先时请求状态传输
+type StateTransfer struct {
+	LastCommitted    int64
+	LastGlobalViewID int64
+	Suspected        bool // 上一次检查时已经发现落后
+	Recovering       bool // 从预写日志恢复的节点在第一次检查时直接请求状态传输
+}
+
+// checkLagging 由 resolveMsg 在 alarm 到期时调用，判断本节点是否落后于本集群的其他节点
+func (node *Node) checkLagging() {
+	if node.StateTransfer.Recovering {
+		node.StateTransfer.Recovering = false
+		node.fetchState()
+		return
+	}
+
+	node.GlobalViewIDLock.Lock()
+	globalViewID := node.GlobalViewID
+	stable := node.StableCheckpoint.SequenceID
+	node.GlobalViewIDLock.Unlock()
+
+	progressed := node.CommittedSequenceID != node.StateTransfer.LastCommitted || globalViewID != node.StateTransfer.LastGlobalViewID
+	node.StateTransfer.LastCommitted = node.CommittedSequenceID
+	node.StateTransfer.LastGlobalViewID = globalViewID
+	// 已执行的全局轮次对应的最大序号
+	executed := sequenceOfViewID(globalViewID) - 1
+	if progressed || !(stable > executed || node.checkpointsAhead(executed) || node.votesAhead()) {
+		node.StateTransfer.Suspected = false
+		return
+	}
+	// 消息可能只是晚到，下一次检查仍然落后时才请求状态传输
+	if !node.StateTransfer.Suspected {
+		node.StateTransfer.Suspected = true
+		return
+	}
+	node.StateTransfer.Suspected = false
+	node.fetchState()
+}
+
+// checkpointsAhead 委员会中至少 f+1 个成员已经为尚未执行的序号发出了 CHECKPOINT，其中至少有一个正常节点
+func (node *Node) checkpointsAhead(executed int64) bool {
+	for sequenceID, msgs := range node.CheckpointMsgs {
+		if sequenceID <= executed {
+			continue
+		}
+		senders := 0
+		for nodeID := range msgs {
+			if node.inCommittee(node.ClusterName, node.View.Number, nodeID) {
+				senders++
+			}
+		}
+		if senders >= clusterF(node.ClusterName)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// votesAhead 缓存中有委员会中至少 f+1 个成员针对本节点没有的共识实例或更高视图的投票，说明这些节点已经领先
+func (node *Node) votesAhead() bool {
+	voters := make(map[string]bool)
+	collect := func(msgs []*consensus.VoteMsg) {
+		for _, msg := range msgs {
+			if !node.inCommittee(node.ClusterName, msg.ViewNumber, msg.NodeID) {
+				continue
+			}
+			if _, ok := node.States[msg.SequenceID]; !ok || msg.ViewNumber > node.View.Number {
+				voters[msg.NodeID] = true
+			}
+		}
+	}
+	node.MsgBufferLock.PrepareMsgsLock.Lock()
+	collect(node.MsgBuffer.PrepareMsgs)
+	node.MsgBufferLock.PrepareMsgsLock.Unlock()
+	node.MsgBufferLock.CommitMsgsLock.Lock()
+	collect(node.MsgBuffer.CommitMsgs)
+	node.MsgBufferLock.CommitMsgsLock.Unlock()
+	delete(voters, node.NodeID)
+	return len(voters) >= clusterF(node.ClusterName)+1
+}
+
+// fetchState 向本集群其他节点请求已提交序号和已执行轮次之后的状态
+func (node *Node) fetchState() {
+	node.GlobalViewIDLock.Lock()
+	globalViewID := node.GlobalViewID
+	node.GlobalViewIDLock.Unlock()
+
+	fetchMsg := &consensus.FetchStateMsg{
+		SequenceID: node.CommittedSequenceID,
+		ViewID:     globalViewID,
+		ViewNumber: node.View.Number,
+		Cluster:    node.ClusterName,
+		NodeID:     node.NodeID,
+	}
+	fmt.Printf("本节点落后(已提交序号 %d，全局轮次 %d)，向本集群节点请求状态传输\n", node.CommittedSequenceID, globalViewID)
+	node.Broadcast(node.ClusterName, fetchMsg, "/fetchstate")
+}
+
+// GetFetchState 把请求者缺少的状态发给它：请求者还没有执行到稳定检查点时附上快照，
+// 之后是本集群已提交批次的 commit 证明和其他集群主节点签名的批次
+func (node *Node) GetFetchState(msg *consensus.FetchStateMsg) error {
+	if msg.Cluster != node.ClusterName || msg.NodeID == node.NodeID {
+		return nil
+	}
+	url, ok := node.NodeTable[node.ClusterName][msg.NodeID]
+	if !ok {
+		return fmt.Errorf("fetch state from unknown node %s", msg.NodeID)
+	}
+
+	transferMsg := &consensus.StateTransferMsg{
+		CommitCerts: make([]*consensus.CommitCert, 0),
+		Cluster:     node.ClusterName,
+		NodeID:      node.NodeID,
+	}
+	node.ViewChange.Lock.Lock()
+	if node.ViewChange.LastNewView != nil && msg.ViewNumber < node.ViewChange.LastNewView.NewView {
+		transferMsg.NewViewMsg = node.ViewChange.LastNewView
+	}
+	node.ViewChange.Lock.Unlock()
+
+	from := msg.SequenceID
+	globalFrom := msg.ViewID
+	node.GlobalViewIDLock.Lock()
+	stable := node.StableCheckpoint
+	if msg.ViewID <= viewIDOfSequence(stable.SequenceID) {
+		if snapshot, ok := node.Snapshots[stable.SequenceID]; ok {
+			transferMsg.Checkpoint = stable
+			transferMsg.Snapshot = snapshot
+			globalFrom = snapshot.ViewID
+			if from < stable.SequenceID {
+				from = stable.SequenceID
+			}
+		}
+	}
+	transferMsg.GlobalShareMsgs = node.GlobalLog.SharesFrom(globalFrom)
+	node.GlobalViewIDLock.Unlock()
+
+	// 稳定检查点之后已提交的实例都还保留在 States 中
+	for sequenceID := from + 1; sequenceID <= node.CommittedSequenceID; sequenceID++ {
+		state, ok := node.States[sequenceID]
+		if !ok {
+			break
+		}
+		cert := state.CommitCert()
+		if cert == nil {
+			break
+		}
+		transferMsg.CommitCerts = append(transferMsg.CommitCerts, cert)
+	}
+
+	if transferMsg.Snapshot == nil && transferMsg.NewViewMsg == nil &&
+		len(transferMsg.CommitCerts) == 0 && len(transferMsg.GlobalShareMsgs) == 0 {
+		return nil
+	}
+	jsonMsg, err := json.Marshal(transferMsg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("向 %s 发送状态传输: 快照 %t，%d 个已提交批次，%d 条全局消息\n",
+		msg.NodeID, transferMsg.Snapshot != nil, len(transferMsg.CommitCerts), len(transferMsg.GlobalShareMsgs))
+	send(url+"/state", jsonMsg)
+	return nil
+}
+
+// GetStateTransfer 逐一验证收到的状态并追上其他节点，已经拥有的部分直接跳过
+func (node *Node) GetStateTransfer(msg *consensus.StateTransferMsg) error {
+	if msg.Cluster != node.ClusterName {
+		return fmt.Errorf("state transfer from other cluster %s", msg.Cluster)
+	}
+
+	if msg.NewViewMsg != nil && msg.NewViewMsg.NewView > node.View.Number {
+		if err := node.GetNewView(msg.NewViewMsg); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if msg.Snapshot != nil {
+		if err := node.installSnapshot(msg.Checkpoint, msg.Snapshot); err != nil {
+			return err
+		}
+	}
+	for _, shareMsg := range msg.GlobalShareMsgs {
+		if err := node.applyGlobalShare(shareMsg); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	certs := msg.CommitCerts
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].PrePrepareMsg.SequenceID < certs[j].PrePrepareMsg.SequenceID
+	})
+	for _, cert := range certs {
+		if err := node.applyCommitCert(cert); err != nil {
+			fmt.Println(err)
+			break
+		}
+	}
+	fmt.Printf("收到 %s 的状态传输，已提交序号 %d\n", msg.NodeID, node.CommittedSequenceID)
+
+	if err := node.commitInOrder(); err != nil {
+		return err
+	}
+	node.GlobalViewIDLock.Lock()
+	node.replyReadyRounds()
+	node.GlobalViewIDLock.Unlock()
+	return nil
+}
+
+// installSnapshot 验证快照与稳定检查点一致后用它替换本地状态
+func (node *Node) installSnapshot(checkpoint *consensus.Checkpoint, snapshot *consensus.Snapshot) error {
+	if checkpoint == nil || snapshot.SequenceID != checkpoint.SequenceID || snapshotDigest(snapshot) != checkpoint.Digest {
+		return errors.New("snapshot does not match the checkpoint")
+	}
+	if err := node.verifyCheckpoint(checkpoint); err != nil {
+		return err
+	}
+
+	node.GlobalViewIDLock.Lock()
+	if node.GlobalViewID >= snapshot.ViewID {
+		node.GlobalViewIDLock.Unlock()
+		return nil
+	}
+	node.WAL.Append(walSnapshot, &walSnapshotRecord{Checkpoint: checkpoint, Snapshot: snapshot})
+	err := node.restoreSnapshot(checkpoint, snapshot)
+	node.GlobalViewIDLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	node.collectGarbage()
+	fmt.Printf("安装序号 %d 的快照，全局轮次 %d\n", snapshot.SequenceID, snapshot.ViewID)
+	return nil
+}
+
+// restoreSnapshot 恢复状态机、回复缓存和状态摘要，并把本地序号和全局轮次快进到快照处，调用时需持有 GlobalViewIDLock
+func (node *Node) restoreSnapshot(checkpoint *consensus.Checkpoint, snapshot *consensus.Snapshot) error {
+	if err := node.App.Restore(snapshot.App); err != nil {
+		return err
+	}
+	if err := node.ClientTable.Restore(snapshot.Clients); err != nil {
+		return err
+	}
+	if err := node.Reputation.Restore(snapshot.Scores); err != nil {
+		return err
+	}
+	node.StateDigest = snapshot.StateDigest
+	node.BlockHash = snapshot.BlockHash
+	node.GlobalViewID = snapshot.ViewID
+	node.CommittedMsgs = make([]*consensus.RequestMsg, 0)
+	node.CommittedBase = snapshot.Executed
+	node.Snapshots[snapshot.SequenceID] = snapshot
+	if checkpoint.SequenceID > node.StableCheckpoint.SequenceID {
+		node.StableCheckpoint = checkpoint
+	}
+
+	// 快照之前的共识实例不再需要
+	node.StatesLock.Lock()
+	if node.CommittedSequenceID < snapshot.SequenceID {
+		node.CommittedSequenceID = snapshot.SequenceID
+		node.View.ID = viewIDOfSequence(snapshot.SequenceID + 1)
+	}
+	for sequenceID := range node.States {
+		if sequenceID <= snapshot.SequenceID {
+			delete(node.States, sequenceID)
+		}
+	}
+	node.StatesLock.Unlock()
+	node.truncateGlobalLog()
+	return nil
+}
+
+// applyCommitCert 验证 commit 证明后直接把对应的实例标记为已提交，之后由 commitInOrder 按序号提交
+func (node *Node) applyCommitCert(cert *consensus.CommitCert) error {
+	prePrepareMsg := cert.PrePrepareMsg
+	if prePrepareMsg.SequenceID <= node.CommittedSequenceID {
+		return nil
+	}
+	if state, ok := node.States[prePrepareMsg.SequenceID]; ok && state.CurrentStage == consensus.Committed {
+		return nil
+	}
+	if err := node.verifyCommitCert(cert); err != nil {
+		return err
+	}
+
+	state, err := node.installPrePrepare(prePrepareMsg)
+	if err != nil {
+		return err
+	}
+	for _, msg := range cert.CommitMsgs {
+		state.MsgLogs.CommitMsgs[msg.NodeID] = msg
+	}
+	state.CurrentStage = consensus.Committed
+
+	node.WAL.Append(walPrePrepare, prePrepareMsg)
+	node.WAL.Append(walCommitted, &walCommit{SequenceID: prePrepareMsg.SequenceID, CommitMsgs: cert.CommitMsgs})
+	return nil
+}
+
+// installPrePrepare 为已经有证明的 pre-prepare 创建共识实例，不检查水位和视图，用于状态传输和重放预写日志
+func (node *Node) installPrePrepare(prePrepareMsg *consensus.PrePrepareMsg) (*consensus.State, error) {
+	state := consensus.CreateState(viewIDOfSequence(prePrepareMsg.SequenceID), prePrepareMsg.SequenceID-1)
+	state.SetCommittee(node.Committee(node.ClusterName, prePrepareMsg.ViewNumber))
+	if _, err := state.PrePrepare(prePrepareMsg); err != nil {
+		return nil, err
+	}
+	node.StatesLock.Lock()
+	node.States[prePrepareMsg.SequenceID] = state
+	node.StatesLock.Unlock()
+	return state, nil
+}
+
+// verifyCommitCert commit 证明需要 2f+1 个本集群节点对同一批次的 commit 签名
+func (node *Node) verifyCommitCert(cert *consensus.CommitCert) error {
+	prePrepareMsg := cert.PrePrepareMsg
+	if prePrepareMsg == nil || prePrepareMsg.RequestMsg == nil {
+		return errors.New("commit certificate without pre-prepare")
+	}
+	if prePrepareMsg.ViewID != viewIDOfSequence(prePrepareMsg.SequenceID) {
+		return errors.New("commit certificate ViewID does not match its sequence ID")
+	}
+	reqDigest, err := json.Marshal(prePrepareMsg.RequestMsg)
+	if err != nil || consensus.Hash(reqDigest) != prePrepareMsg.Digest {
+		return errors.New("commit certificate digest mismatch")
+	}
+
+	return node.verifyCommitVotes(node.ClusterName, prePrepareMsg.Digest, prePrepareMsg.ViewID, cert.CommitMsgs)
+}
+
+// verifyCommitVotes 检查 votes 中至少有 cluster 的 2f+1 个不同节点对轮次 viewID 中摘要为 digest 的批次的 commit 签名
+func (node *Node) verifyCommitVotes(cluster string, digest string, viewID int64, votes []*consensus.VoteMsg) error {
+	if len(node.commitVoters(cluster, digest, viewID, votes)) < 2*clusterF(cluster)+1 {
+		return fmt.Errorf("commit certificate of %s does not contain 2f+1 commit votes", cluster)
+	}
+	return nil
+}
+
+// verifyGlobalShare 其他集群发来的批次必须附带该集群 2f+1 个节点的 commit 投票，主节点一个人的签名不足以证明批次已经提交
+func (node *Node) verifyGlobalShare(shareMsg *consensus.GlobalShareMsg) error {
+	reqDigest, err := json.Marshal(shareMsg.RequestMsg)
+	if err != nil || consensus.Hash(reqDigest) != shareMsg.Digest {
+		return errors.New("global share message digest mismatch")
+	}
+	if shareMsg.RequestMsg.SequenceID != sequenceOfViewID(shareMsg.ViewID) {
+		return fmt.Errorf("global share message carries batch of sequence %d in round %d", shareMsg.RequestMsg.SequenceID, shareMsg.ViewID)
+	}
+	return node.verifyCommitVotes(shareMsg.Cluster, shareMsg.Digest, shareMsg.ViewID, shareMsg.CommitMsgs)
+}
+
+// applyGlobalShare 验证其他集群的 commit 证明和主节点的签名后保存尚未执行的批次
+func (node *Node) applyGlobalShare(shareMsg *consensus.GlobalShareMsg) error {
+	if shareMsg.Cluster == node.ClusterName || shareMsg.RequestMsg == nil {
+		return errors.New("invalid global share message in state transfer")
+	}
+	if _, ok := node.NodeTable[shareMsg.Cluster][shareMsg.NodeID]; !ok {
+		return fmt.Errorf("global share message from unknown node %s", shareMsg.NodeID)
+	}
+	if _, ok := node.GlobalLog.Get(shareMsg.Cluster, shareMsg.ViewID); ok {
+		return nil
+	}
+	node.GlobalViewIDLock.Lock()
+	executed := shareMsg.ViewID < node.GlobalViewID
+	node.GlobalViewIDLock.Unlock()
+	if executed {
+		return nil
+	}
+
+	if shareMsg.NodeID != node.PrimaryOf(shareMsg.Cluster, shareMsg.ViewNumber) {
+		return fmt.Errorf("global share message is not sent by the primary of %s", shareMsg.Cluster)
+	}
+	if err := node.verifyGlobalShare(shareMsg); err != nil {
+		return err
+	}
+	digestByte, _ := hex.DecodeString(shareMsg.Digest)
+	if err := node.RsaVerySignWithSha256(digestByte, shareMsg.Sign, node.getPubKey(shareMsg.Cluster, shareMsg.NodeID)); err != nil {
+		return fmt.Errorf("global share message has an invalid signature: %s", err)
+	}
+
+	node.WAL.Append(walGlobal, shareMsg)
+	node.GlobalLog.SaveShare(shareMsg)
+	return nil
+}
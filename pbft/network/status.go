@@ -0,0 +1,234 @@
+package network
+
+import (
+	"simple_pbft/pbft/consensus"
+	"sort"
+)
+
+// NodeStatus 节点当前的共识进度，由 /status 返回
+type NodeStatus struct {
+	NodeID              string           `json:"nodeID"`
+	Cluster             string           `json:"ClusterName"`
+	Primary             string           `json:"primary"`
+	Role                string           `json:"role"` // committee 或 observer
+	ViewNumber          int64            `json:"viewNumber"`
+	ViewID              int64            `json:"viewID"`       // 本地共识轮次
+	GlobalViewID        int64            `json:"globalViewID"` // 下一个要执行的全局轮次
+	CommittedSequenceID int64            `json:"committedSequenceID"`
+	StableCheckpoint    int64            `json:"stableCheckpoint"`
+	LedgerHeight        int64            `json:"ledgerHeight"`
+	BlockHash           string           `json:"blockHash"`
+	StateDigest         string           `json:"stateDigest"`
+	ViewChanging        bool             `json:"viewChanging"`
+	Stages              map[int64]string `json:"stages"`  // SequenceID - 尚未提交的共识实例所处的阶段
+	Buffers             map[string]int   `json:"buffers"` // 各消息缓冲区中的消息数量
+	Invalid             map[string]int   `json:"invalid"` // 各发送者被丢弃的无效消息数量
+}
+
+// ClusterMember 集群中的一个节点
+type ClusterMember struct {
+	NodeID    string `json:"nodeID"`
+	URL       string `json:"url"`
+	Primary   bool   `json:"primary"`
+	Committee bool   `json:"committee"` // 是否是当前视图的委员会节点，否则为观察节点
+}
+
+// ClusterStatus 本集群的成员以及已知的其他集群主节点，由 /cluster 返回
+type ClusterStatus struct {
+	Cluster    string            `json:"ClusterName"`
+	ViewNumber int64             `json:"viewNumber"`
+	F          int               `json:"f"`
+	Members    []*ClusterMember  `json:"members"`
+	Primaries  map[string]string `json:"primaries"` // cluster - 已知视图下的主节点
+}
+
+// RequestStatus 请求所在的区块以及缓存的执行结果，由 /requests/{client}/{timestamp} 返回
+type RequestStatus struct {
+	Height     int64                 `json:"height"`
+	BlockHash  string                `json:"blockHash"`
+	RequestMsg *consensus.RequestMsg `json:"requestMsg"`
+	Reply      *consensus.ReplyMsg   `json:"reply"` // 回复已被淘汰时为空
+}
+
+// RoundOrder 一个全局轮次中请求的执行顺序，由 /rounds/{height} 返回，不同节点返回的内容应完全相同
+type RoundOrder struct {
+	Height     int64           `json:"height"`
+	ViewID     int64           `json:"viewID"`
+	Clusters   []string        `json:"clusters"` // 批次的执行顺序
+	Requests   []*OrderedEntry `json:"requests"`
+	MerkleRoot string          `json:"merkleRoot"`
+	BlockHash  string          `json:"blockHash"`
+}
+
+// OrderedEntry 按执行顺序排列的一个请求
+type OrderedEntry struct {
+	Cluster   string `json:"ClusterName"`
+	ClientID  string `json:"clientID"`
+	Timestamp int64  `json:"timestamp"`
+	Operation string `json:"operation"`
+}
+
+var stageNames = map[consensus.Stage]string{
+	consensus.Idle:        "Idle",
+	consensus.PrePrepared: "PrePrepared",
+	consensus.Prepared:    "Prepared",
+	consensus.Committed:   "Committed",
+	consensus.GetRequest:  "GetRequest",
+}
+
+// Status 返回节点当前的共识进度，只读取状态，不修改
+func (node *Node) Status() *NodeStatus {
+	status := &NodeStatus{
+		NodeID:       node.NodeID,
+		Cluster:      node.ClusterName,
+		Role:         "committee",
+		LedgerHeight: node.Ledger.Height(),
+		Stages:       make(map[int64]string),
+		Buffers:      make(map[string]int),
+	}
+	// 视图和已提交序号由 resolveMsg 在 StatesLock 下修改
+	node.StatesLock.RLock()
+	status.Primary = node.View.Primary
+	status.ViewNumber = node.View.Number
+	status.ViewID = node.View.ID
+	status.CommittedSequenceID = node.CommittedSequenceID
+	for sequenceID, state := range node.States {
+		if sequenceID > status.CommittedSequenceID {
+			status.Stages[sequenceID] = stageNames[state.CurrentStage]
+		}
+	}
+	node.StatesLock.RUnlock()
+	if !node.inCommittee(node.ClusterName, status.ViewNumber, node.NodeID) {
+		status.Role = "observer"
+	}
+	status.Invalid = make(map[string]int)
+	node.InvalidMsgsLock.Lock()
+	for sender, count := range node.InvalidMsgs {
+		status.Invalid[sender] = count
+	}
+	node.InvalidMsgsLock.Unlock()
+
+	node.GlobalViewIDLock.Lock()
+	status.GlobalViewID = node.GlobalViewID
+	status.StableCheckpoint = node.StableCheckpoint.SequenceID
+	status.BlockHash = node.BlockHash
+	status.StateDigest = node.StateDigest
+	node.GlobalViewIDLock.Unlock()
+
+	node.ViewChange.Lock.Lock()
+	status.ViewChanging = node.ViewChange.Changing
+	node.ViewChange.Lock.Unlock()
+
+	node.MsgBufferLock.ReqMsgsLock.Lock()
+	status.Buffers["request"] = len(node.MsgBuffer.ReqMsgs)
+	node.MsgBufferLock.ReqMsgsLock.Unlock()
+	node.MsgBufferLock.PrePrepareMsgsLock.Lock()
+	status.Buffers["preprepare"] = len(node.MsgBuffer.PrePrepareMsgs)
+	node.MsgBufferLock.PrePrepareMsgsLock.Unlock()
+	node.MsgBufferLock.PrepareMsgsLock.Lock()
+	status.Buffers["prepare"] = len(node.MsgBuffer.PrepareMsgs)
+	node.MsgBufferLock.PrepareMsgsLock.Unlock()
+	node.MsgBufferLock.CommitMsgsLock.Lock()
+	status.Buffers["commit"] = len(node.MsgBuffer.CommitMsgs)
+	node.MsgBufferLock.CommitMsgsLock.Unlock()
+	node.MsgBufferLock.ViewChangeMsgsLock.Lock()
+	status.Buffers["viewchange"] = len(node.MsgBuffer.ViewChangeMsgs)
+	status.Buffers["newview"] = len(node.MsgBuffer.NewViewMsgs)
+	node.MsgBufferLock.ViewChangeMsgsLock.Unlock()
+	node.MsgBufferLock.CheckpointMsgsLock.Lock()
+	status.Buffers["checkpoint"] = len(node.MsgBuffer.CheckpointMsgs)
+	status.Buffers["fetchstate"] = len(node.MsgBuffer.FetchStateMsgs)
+	status.Buffers["state"] = len(node.MsgBuffer.StateTransferMsgs)
+	node.MsgBufferLock.CheckpointMsgsLock.Unlock()
+	status.Buffers["entrance"] = len(node.MsgEntrance)
+	status.Buffers["global"] = len(node.MsgGlobal)
+
+	return status
+}
+
+// Cluster 返回本集群的成员和各集群当前的主节点
+func (node *Node) Cluster() *ClusterStatus {
+	// 视图由 resolveMsg 在 StatesLock 下修改
+	node.StatesLock.RLock()
+	viewNumber := node.View.Number
+	primary := node.View.Primary
+	node.StatesLock.RUnlock()
+
+	status := &ClusterStatus{
+		Cluster:    node.ClusterName,
+		ViewNumber: viewNumber,
+		F:          clusterF(node.ClusterName),
+		Members:    make([]*ClusterMember, 0, len(node.NodeTable[node.ClusterName])),
+		Primaries:  make(map[string]string),
+	}
+	for nodeID, url := range node.NodeTable[node.ClusterName] {
+		status.Members = append(status.Members, &ClusterMember{
+			NodeID:    nodeID,
+			URL:       url,
+			Primary:   nodeID == primary,
+			Committee: node.inCommittee(node.ClusterName, viewNumber, nodeID),
+		})
+	}
+	sort.Slice(status.Members, func(i, j int) bool {
+		return status.Members[i].NodeID < status.Members[j].NodeID
+	})
+
+	node.ClusterViewsLock.Lock()
+	for i := 0; i < ClusterNumber; i++ {
+		if Allcluster[i] == node.ClusterName {
+			status.Primaries[Allcluster[i]] = primary
+		} else {
+			status.Primaries[Allcluster[i]] = node.PrimaryOf(Allcluster[i], node.ClusterViews[Allcluster[i]])
+		}
+	}
+	node.ClusterViewsLock.Unlock()
+	return status
+}
+
+// RequestStatus 在账本中查找请求 (clientID, timestamp)，请求尚未执行时返回 nil
+func (node *Node) RequestStatus(clientID string, timestamp int64) (*RequestStatus, error) {
+	block, err := node.Ledger.FindRequest(clientID, timestamp)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	status := &RequestStatus{Height: block.Height, BlockHash: block.Hash}
+	for _, reqMsg := range block.Requests() {
+		if reqMsg.ClientID == clientID && reqMsg.Timestamp == timestamp {
+			status.RequestMsg = reqMsg
+			break
+		}
+	}
+	status.Reply, _ = node.ClientTable.Lookup(status.RequestMsg)
+	return status, nil
+}
+
+// RoundOrder 从账本中读取高度为 height 的区块，返回该轮次的执行顺序，区块尚未写入时返回 nil
+func (node *Node) RoundOrder(height int64) (*RoundOrder, error) {
+	block, err := node.Ledger.Block(height)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	order := &RoundOrder{
+		Height:     block.Height,
+		ViewID:     block.ViewID,
+		Clusters:   make([]string, 0, len(block.Batches)),
+		Requests:   make([]*OrderedEntry, 0),
+		MerkleRoot: block.MerkleRoot,
+		BlockHash:  block.Hash,
+	}
+	for _, batch := range block.Batches {
+		order.Clusters = append(order.Clusters, batch.Cluster)
+		if batch.RequestMsg == nil {
+			continue
+		}
+		for _, reqMsg := range batch.RequestMsg.Requests {
+			order.Requests = append(order.Requests, &OrderedEntry{
+				Cluster:   batch.Cluster,
+				ClientID:  reqMsg.ClientID,
+				Timestamp: reqMsg.Timestamp,
+				Operation: reqMsg.Operation,
+			})
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,616 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"simple_pbft/pbft/consensus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ViewChangeTimeout 备份节点等待本地共识完成的初始超时时间，连续视图切换时翻倍
+var ViewChangeTimeout = time.Second * 5
+
+// ViewChangeState 记录视图切换过程中的状态以及请求计时器
+type ViewChangeState struct {
+	Changing    bool
+	PendingView int64                                         // 正在切换到的目标视图
+	Deadline    time.Time                                     // 请求计时器到期时间，零值表示计时器未启动
+	Timeout     time.Duration                                 // 当前超时时间
+	Msgs        map[int64]map[string]*consensus.ViewChangeMsg // newView - nodeID - msg
+	NewViewSent map[int64]bool
+	LastNewView *consensus.NewViewMsg // 最近一次进入的新视图，状态传输时转发给视图落后的节点
+	Deferred    *consensus.NewViewMsg // 所在纪元尚未选举时收到的 NEW-VIEW，执行选举后再处理
+
+	Lock sync.Mutex
+}
+
+func NewViewChangeState() *ViewChangeState {
+	return &ViewChangeState{
+		Timeout:     ViewChangeTimeout,
+		Msgs:        make(map[int64]map[string]*consensus.ViewChangeMsg),
+		NewViewSent: make(map[int64]bool),
+	}
+}
+
+func (vc *ViewChangeState) IsChanging() bool {
+	vc.Lock.Lock()
+	defer vc.Lock.Unlock()
+	return vc.Changing
+}
+
+// PrimaryOf 根据视图编号确定集群的主节点。纪元 0 中主节点在编号最小的 3f+1 个节点中轮换: p = v mod (3f+1)，
+// 之后的纪元按选举出的排名轮换，见 electPrimaries
+func (node *Node) PrimaryOf(cluster string, viewNumber int64) string {
+	node.Reputation.Lock.Lock()
+	defer node.Reputation.Lock.Unlock()
+	return node.primaryOf(cluster, viewNumber)
+}
+
+// startViewChangeTimer 备份节点在等待本地共识时启动请求计时器，计时器已启动时不做任何事
+func (node *Node) startViewChangeTimer() {
+	if node.NodeID == node.View.Primary || node.isObserver() {
+		return
+	}
+	node.ViewChange.Lock.Lock()
+	defer node.ViewChange.Lock.Unlock()
+	if node.ViewChange.Changing || !node.ViewChange.Deadline.IsZero() {
+		return
+	}
+	node.ViewChange.Deadline = time.Now().Add(node.ViewChange.Timeout)
+}
+
+func (node *Node) stopViewChangeTimer() {
+	node.ViewChange.Lock.Lock()
+	defer node.ViewChange.Lock.Unlock()
+	if node.ViewChange.Changing {
+		return
+	}
+	node.ViewChange.Deadline = time.Time{}
+}
+
+// checkViewChangeTimer 由 alarm 定期调用，计时器超时则发起(或继续推进)视图切换
+func (node *Node) checkViewChangeTimer() {
+	node.ViewChange.Lock.Lock()
+	if node.ViewChange.Deadline.IsZero() || time.Now().Before(node.ViewChange.Deadline) {
+		node.ViewChange.Lock.Unlock()
+		return
+	}
+	view := node.View.Number
+	if node.ViewChange.Changing {
+		// 在等待 NEW-VIEW 时再次超时，切换到下一个视图并加倍超时时间
+		view = node.ViewChange.PendingView
+		node.ViewChange.Timeout *= 2
+	}
+	node.ViewChange.Lock.Unlock()
+	newView := node.nextView(view)
+
+	fmt.Printf("请求计时器超时，发起视图切换 %d -> %d\n", node.View.Number, newView)
+	node.startViewChange(newView)
+}
+
+// startViewChange 停止接收正常共识消息，并向本集群广播 VIEW-CHANGE 消息。
+// 只有当前视图或新视图的委员会节点参与视图切换，其他观察节点等待 NEW-VIEW
+func (node *Node) startViewChange(newView int64) {
+	if !node.inCommittee(node.ClusterName, node.View.Number, node.NodeID) && !node.inCommittee(node.ClusterName, newView, node.NodeID) {
+		return
+	}
+	node.ViewChange.Lock.Lock()
+	if node.ViewChange.Changing && node.ViewChange.PendingView >= newView {
+		node.ViewChange.Lock.Unlock()
+		return
+	}
+	node.ViewChange.Changing = true
+	node.ViewChange.PendingView = newView
+	node.ViewChange.Deadline = time.Now().Add(node.ViewChange.Timeout)
+	node.ViewChange.Lock.Unlock()
+
+	// 其他协程会创建共识实例并推进视图，读取视图和遍历 States 时持有 StatesLock
+	node.StatesLock.RLock()
+	viewChangeMsg := &consensus.ViewChangeMsg{
+		NewView:       newView,
+		View:          node.View.Number,
+		ViewID:        node.View.ID,
+		Checkpoint:    node.StableCheckpoint,
+		PreparedCerts: make([]*consensus.PreparedCert, 0),
+		Cluster:       node.ClusterName,
+		NodeID:        node.NodeID,
+	}
+	// 稳定检查点之后所有已 prepared 的请求都需要附上证明，其他节点可能还没有提交它们
+	for sequenceID, state := range node.States {
+		if sequenceID <= node.StableCheckpoint.SequenceID {
+			continue
+		}
+		if cert := state.PreparedCert(); cert != nil {
+			viewChangeMsg.PreparedCerts = append(viewChangeMsg.PreparedCerts, cert)
+		}
+	}
+	node.StatesLock.RUnlock()
+	viewChangeMsg.Digest, viewChangeMsg.Sign = node.signMsg(viewChangeMsg)
+
+	LogStage(fmt.Sprintf("View-Change (NewView:%d)", newView), false)
+	node.saveViewChangeMsg(viewChangeMsg)
+	node.Broadcast(node.ClusterName, viewChangeMsg, "/viewchange")
+
+	node.tryNewView(newView)
+}
+
+func (node *Node) saveViewChangeMsg(msg *consensus.ViewChangeMsg) int {
+	node.ViewChange.Lock.Lock()
+	defer node.ViewChange.Lock.Unlock()
+	if node.ViewChange.Msgs[msg.NewView] == nil {
+		node.ViewChange.Msgs[msg.NewView] = make(map[string]*consensus.ViewChangeMsg)
+	}
+	node.ViewChange.Msgs[msg.NewView][msg.NodeID] = msg
+	return len(node.ViewChange.Msgs[msg.NewView])
+}
+
+// GetViewChange 处理其他节点发来的 VIEW-CHANGE 消息
+func (node *Node) GetViewChange(msg *consensus.ViewChangeMsg) error {
+	if msg.NewView <= node.View.Number {
+		return nil
+	}
+	if err := node.verifyViewChangeMsg(msg); err != nil {
+		return err
+	}
+
+	node.saveViewChangeMsg(msg)
+	node.ViewChange.Lock.Lock()
+	msgs := make([]*consensus.ViewChangeMsg, 0, len(node.ViewChange.Msgs[msg.NewView]))
+	for _, viewChangeMsg := range node.ViewChange.Msgs[msg.NewView] {
+		msgs = append(msgs, viewChangeMsg)
+	}
+	node.ViewChange.Lock.Unlock()
+	count := node.viewChangeVotes(msgs)
+	fmt.Printf("[View-Change-Vote]: NewView %d, %d\n", msg.NewView, count)
+
+	// 收到委员会中 f+1 个节点要求切换到同一个更高的视图，说明至少有一个正常节点超时，跟随切换
+	node.ViewChange.Lock.Lock()
+	join := count >= clusterF(node.ClusterName)+1 && (!node.ViewChange.Changing || node.ViewChange.PendingView < msg.NewView)
+	node.ViewChange.Lock.Unlock()
+	if join {
+		node.startViewChange(msg.NewView)
+	}
+
+	node.tryNewView(msg.NewView)
+	return nil
+}
+
+// tryNewView 新视图的主节点收集到 2f+1 条 VIEW-CHANGE 后广播 NEW-VIEW 并进入新视图
+func (node *Node) tryNewView(newView int64) {
+	if node.PrimaryOf(node.ClusterName, newView) != node.NodeID {
+		return
+	}
+
+	node.ViewChange.Lock.Lock()
+	if node.ViewChange.NewViewSent[newView] || node.ViewChange.Msgs[newView][node.NodeID] == nil {
+		node.ViewChange.Lock.Unlock()
+		return
+	}
+	viewChangeMsgs := make([]*consensus.ViewChangeMsg, 0, len(node.ViewChange.Msgs[newView]))
+	for _, msg := range node.ViewChange.Msgs[newView] {
+		viewChangeMsgs = append(viewChangeMsgs, msg)
+	}
+	node.ViewChange.Lock.Unlock()
+	if node.viewChangeVotes(viewChangeMsgs) < 2*clusterF(node.ClusterName)+1 {
+		return
+	}
+	node.ViewChange.Lock.Lock()
+	if node.ViewChange.NewViewSent[newView] {
+		node.ViewChange.Lock.Unlock()
+		return
+	}
+	node.ViewChange.NewViewSent[newView] = true
+	node.ViewChange.Lock.Unlock()
+
+	newViewMsg := &consensus.NewViewMsg{
+		NewView:        newView,
+		ViewChangeMsgs: viewChangeMsgs,
+		PrePrepareMsgs: make([]*consensus.PrePrepareMsg, 0),
+		NodeID:         node.NodeID,
+	}
+	// 在新视图中重新提出最高视图下已 prepared 的请求，中间没有请求的序号用空批次填补
+	for _, prePrepareMsg := range selectPreparedRequests(viewChangeMsgs) {
+		reProposal := *prePrepareMsg
+		reProposal.ViewNumber = newView
+		reProposal.NodeID = node.NodeID
+		digestByte, _ := hex.DecodeString(reProposal.Digest)
+		reProposal.Sign = node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
+		newViewMsg.PrePrepareMsgs = append(newViewMsg.PrePrepareMsgs, &reProposal)
+	}
+	newViewMsg.Digest, newViewMsg.Sign = node.signMsg(newViewMsg)
+
+	node.Broadcast(node.ClusterName, newViewMsg, "/newview")
+	node.ViewChange.Lock.Lock()
+	node.ViewChange.LastNewView = newViewMsg
+	node.ViewChange.Lock.Unlock()
+	node.enterNewView(newView, node.NodeID)
+	node.resendForwardedRequests()
+	node.reshareCommitted()
+	if newView%ViewsPerEpoch == 0 {
+		node.announcePrimary(newView)
+	}
+
+	for _, prePrepareMsg := range newViewMsg.PrePrepareMsgs {
+		state, err := node.createStateForNewConsensus(prePrepareMsg.SequenceID, true)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if _, err := state.PrePrepare(prePrepareMsg); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		node.WAL.Append(walPrePrepare, prePrepareMsg)
+	}
+	LogStage(fmt.Sprintf("New-View (View:%d, Primary:%s)", newView, node.NodeID), true)
+}
+
+// GetNewView 备份节点验证 NEW-VIEW 消息后进入新视图，并处理其中重新提出的请求
+func (node *Node) GetNewView(msg *consensus.NewViewMsg) error {
+	if msg.NewView <= node.View.Number {
+		return nil
+	}
+	primary := node.PrimaryOf(node.ClusterName, msg.NewView)
+	if primary == "" {
+		// 本节点还没有执行到这个纪元的选举
+		node.ViewChange.Lock.Lock()
+		node.ViewChange.Deferred = msg
+		node.ViewChange.Lock.Unlock()
+		fmt.Printf("视图 %d 所在的纪元尚未选举，暂缓处理 NEW-VIEW\n", msg.NewView)
+		return nil
+	}
+	if msg.NodeID != primary {
+		return fmt.Errorf("new-view for view %d is not sent by its primary: %s", msg.NewView, msg.NodeID)
+	}
+	if err := node.verifyMsgSign(msg.NodeID, msg.Digest, msg.Sign, newViewDigest(msg)); err != nil {
+		return err
+	}
+
+	valid := make([]*consensus.ViewChangeMsg, 0, len(msg.ViewChangeMsgs))
+	for _, viewChangeMsg := range msg.ViewChangeMsgs {
+		if viewChangeMsg.NewView != msg.NewView || viewChangeMsg.Cluster != node.ClusterName {
+			continue
+		}
+		if err := node.verifyViewChangeMsg(viewChangeMsg); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		valid = append(valid, viewChangeMsg)
+	}
+	if node.viewChangeVotes(valid) < 2*clusterF(node.ClusterName)+1 {
+		return errors.New("new-view message does not contain 2f+1 valid view-change messages")
+	}
+	// 重新提出的请求必须与根据这些 VIEW-CHANGE 选出的请求完全一致，否则新的主节点可能替换或遗漏已 prepared 的请求
+	if err := checkReProposals(selectPreparedRequests(valid), msg); err != nil {
+		return err
+	}
+
+	node.ViewChange.Lock.Lock()
+	node.ViewChange.LastNewView = msg
+	node.ViewChange.Lock.Unlock()
+	node.enterNewView(msg.NewView, msg.NodeID)
+	node.resendForwardedRequests()
+	LogStage(fmt.Sprintf("New-View (View:%d, Primary:%s)", msg.NewView, msg.NodeID), true)
+
+	for _, prePrepareMsg := range msg.PrePrepareMsgs {
+		if err := node.GetPrePrepare(prePrepareMsg, true); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+// checkReProposals 比较 NEW-VIEW 中重新提出的 pre-prepare 与备份节点自己选出的请求
+func checkReProposals(expected []*consensus.PrePrepareMsg, msg *consensus.NewViewMsg) error {
+	if len(expected) != len(msg.PrePrepareMsgs) {
+		return fmt.Errorf("new-view re-proposes %d requests, expect %d", len(msg.PrePrepareMsgs), len(expected))
+	}
+	for i, prePrepareMsg := range msg.PrePrepareMsgs {
+		want := expected[i]
+		if prePrepareMsg.SequenceID != want.SequenceID || prePrepareMsg.ViewID != want.ViewID || prePrepareMsg.Digest != want.Digest {
+			return fmt.Errorf("new-view re-proposal for sequence %d does not match the prepared request", want.SequenceID)
+		}
+		if prePrepareMsg.ViewNumber != msg.NewView || prePrepareMsg.NodeID != msg.NodeID {
+			return fmt.Errorf("new-view re-proposal for sequence %d is not proposed in view %d", want.SequenceID, msg.NewView)
+		}
+	}
+	return nil
+}
+
+// viewChangeVotes 统计要求切换到同一视图的 VIEW-CHANGE 中来自发送者所在视图的委员会节点的数量。
+// 委员会随视图变化，按发送者声明的当前视图分组，返回最多的一组
+func (node *Node) viewChangeVotes(msgs []*consensus.ViewChangeMsg) int {
+	senders := make(map[int64]map[string]bool) // view - nodeID
+	for _, msg := range msgs {
+		if msg.View >= msg.NewView || !node.inCommittee(node.ClusterName, msg.View, msg.NodeID) {
+			continue
+		}
+		if senders[msg.View] == nil {
+			senders[msg.View] = make(map[string]bool)
+		}
+		senders[msg.View][msg.NodeID] = true
+	}
+	votes := 0
+	for _, nodes := range senders {
+		if len(nodes) > votes {
+			votes = len(nodes)
+		}
+	}
+	return votes
+}
+
+// forwardRequest 备份节点把客户端请求转发给主节点，并在请求提交前保持请求计时器
+func (node *Node) forwardRequest(reqMsg *consensus.RequestMsg) {
+	node.ForwardedReqsLock.Lock()
+	node.ForwardedReqs[requestKey(reqMsg)] = reqMsg
+	node.ForwardedReqsLock.Unlock()
+
+	jsonMsg, err := json.Marshal(reqMsg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("转发客户端请求给主节点 %s\n", node.View.Primary)
+	send(node.NodeTable[node.ClusterName][node.View.Primary]+"/req", jsonMsg)
+	node.startViewChangeTimer()
+}
+
+// removeForwardedRequests 删除已经提交的转发请求，返回剩余未提交的数量
+func (node *Node) removeForwardedRequests(committedMsg *consensus.BatchRequestMsg) int {
+	node.ForwardedReqsLock.Lock()
+	defer node.ForwardedReqsLock.Unlock()
+	for _, reqMsg := range committedMsg.Requests {
+		if reqMsg != nil {
+			delete(node.ForwardedReqs, requestKey(reqMsg))
+		}
+	}
+	return len(node.ForwardedReqs)
+}
+
+// resendForwardedRequests 进入新视图后把尚未提交的转发请求交给新的主节点
+func (node *Node) resendForwardedRequests() {
+	node.ForwardedReqsLock.Lock()
+	reqMsgs := make([]*consensus.RequestMsg, 0, len(node.ForwardedReqs))
+	for _, reqMsg := range node.ForwardedReqs {
+		reqMsgs = append(reqMsgs, reqMsg)
+	}
+	if node.NodeID == node.View.Primary {
+		node.ForwardedReqs = make(map[string]*consensus.RequestMsg)
+	}
+	node.ForwardedReqsLock.Unlock()
+	// 被替换的主节点(例如选举出了新的主节点)缓存中尚未打包的请求同样交给新的主节点
+	if node.NodeID != node.View.Primary {
+		node.MsgBufferLock.ReqMsgsLock.Lock()
+		reqMsgs = append(reqMsgs, node.MsgBuffer.ReqMsgs...)
+		node.MsgBuffer.ReqMsgs = make([]*consensus.RequestMsg, 0)
+		node.MsgBufferLock.ReqMsgsLock.Unlock()
+	}
+
+	go func() {
+		for _, reqMsg := range reqMsgs {
+			node.MsgRequsetchan <- reqMsg
+		}
+	}()
+}
+
+func (node *Node) hasForwardedRequests() bool {
+	node.ForwardedReqsLock.Lock()
+	defer node.ForwardedReqsLock.Unlock()
+	return len(node.ForwardedReqs) > 0
+}
+
+func requestKey(reqMsg *consensus.RequestMsg) string {
+	return reqMsg.ClientID + "-" + strconv.FormatInt(reqMsg.Timestamp, 10)
+}
+
+// enterNewView 切换到新视图，重置本地共识状态
+func (node *Node) enterNewView(newView int64, primary string) {
+	node.WAL.Append(walView, &walViewNumber{ViewNumber: newView})
+	node.StatesLock.Lock()
+	node.View.Number = newView
+	node.View.Primary = primary
+	node.StatesLock.Unlock()
+
+	node.ViewChange.Lock.Lock()
+	node.ViewChange.Changing = false
+	node.ViewChange.Deadline = time.Time{}
+	node.ViewChange.Timeout = ViewChangeTimeout
+	for view := range node.ViewChange.Msgs {
+		if view <= newView {
+			delete(node.ViewChange.Msgs, view)
+		}
+	}
+	node.ViewChange.Lock.Unlock()
+
+	// 丢弃旧视图中尚未提交的请求状态，这些请求需要由新的主节点重新排序
+	node.ClientTable.ResetProposed()
+	node.dropUncommittedStates()
+}
+
+// dropUncommittedStates 删除旧视图中尚未提交的共识实例，已提交的实例在稳定检查点之前继续保留
+func (node *Node) dropUncommittedStates() {
+	node.StatesLock.Lock()
+	defer node.StatesLock.Unlock()
+	for sequenceID, state := range node.States {
+		if state.CurrentStage != consensus.Committed {
+			delete(node.States, sequenceID)
+		}
+	}
+}
+
+// selectPreparedRequests 从 VIEW-CHANGE 消息中为最新稳定检查点之后的每个序号选出视图最高的 prepared 请求，
+// 中间没有 prepared 请求的序号用空批次填补，保证新视图中的序号仍然连续
+func selectPreparedRequests(viewChangeMsgs []*consensus.ViewChangeMsg) []*consensus.PrePrepareMsg {
+	var low, high int64
+	for _, viewChangeMsg := range viewChangeMsgs {
+		if viewChangeMsg.Checkpoint != nil && viewChangeMsg.Checkpoint.SequenceID > low {
+			low = viewChangeMsg.Checkpoint.SequenceID
+		}
+	}
+	high = low
+
+	selected := make(map[int64]*consensus.PrePrepareMsg)
+	for _, viewChangeMsg := range viewChangeMsgs {
+		for _, cert := range viewChangeMsg.PreparedCerts {
+			prePrepareMsg := cert.PrePrepareMsg
+			if prePrepareMsg.SequenceID <= low {
+				continue
+			}
+			if old, ok := selected[prePrepareMsg.SequenceID]; !ok || old.ViewNumber < prePrepareMsg.ViewNumber {
+				selected[prePrepareMsg.SequenceID] = prePrepareMsg
+			}
+			if prePrepareMsg.SequenceID > high {
+				high = prePrepareMsg.SequenceID
+			}
+		}
+	}
+
+	prePrepareMsgs := make([]*consensus.PrePrepareMsg, 0, high-low)
+	for id := low + 1; id <= high; id++ {
+		prePrepareMsg, ok := selected[id]
+		if !ok {
+			prePrepareMsg = nullPrePrepare(id)
+		}
+		prePrepareMsgs = append(prePrepareMsgs, prePrepareMsg)
+	}
+	return prePrepareMsgs
+}
+
+// nullPrePrepare 不包含任何请求的空批次，执行时不改变状态
+func nullPrePrepare(sequenceID int64) *consensus.PrePrepareMsg {
+	batch := &consensus.BatchRequestMsg{Requests: make([]*consensus.RequestMsg, 0), SequenceID: sequenceID}
+	jsonMsg, _ := json.Marshal(batch)
+	return &consensus.PrePrepareMsg{
+		ViewID:     viewIDOfSequence(sequenceID),
+		SequenceID: sequenceID,
+		Digest:     consensus.Hash(jsonMsg),
+		RequestMsg: batch,
+	}
+}
+
+// verifyViewChangeMsg 验证 VIEW-CHANGE 的签名以及其中携带的 prepared 证明
+func (node *Node) verifyViewChangeMsg(msg *consensus.ViewChangeMsg) error {
+	if msg.Cluster != node.ClusterName {
+		return fmt.Errorf("view-change from other cluster %s", msg.Cluster)
+	}
+	if err := node.verifyMsgSign(msg.NodeID, msg.Digest, msg.Sign, viewChangeDigest(msg)); err != nil {
+		return err
+	}
+	if msg.Checkpoint != nil && len(msg.Checkpoint.Proof) > 0 {
+		if err := node.verifyCheckpoint(msg.Checkpoint); err != nil {
+			return err
+		}
+	}
+	for _, cert := range msg.PreparedCerts {
+		if err := node.verifyPreparedCert(cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyPreparedCert prepared 证明需要由对应视图的主节点签名的 pre-prepare 和该视图委员会中 2f 个不同节点签名的 prepare 组成
+func (node *Node) verifyPreparedCert(cert *consensus.PreparedCert) error {
+	prePrepareMsg := cert.PrePrepareMsg
+	if prePrepareMsg == nil || prePrepareMsg.RequestMsg == nil {
+		return errors.New("prepared certificate without pre-prepare")
+	}
+	if prePrepareMsg.NodeID != node.PrimaryOf(node.ClusterName, prePrepareMsg.ViewNumber) {
+		return errors.New("prepared certificate is not proposed by the primary")
+	}
+	reqDigest, err := json.Marshal(prePrepareMsg.RequestMsg)
+	if err != nil || consensus.Hash(reqDigest) != prePrepareMsg.Digest {
+		return errors.New("prepared certificate digest mismatch")
+	}
+	digestByte, _ := hex.DecodeString(prePrepareMsg.Digest)
+	if err := node.RsaVerySignWithSha256(digestByte, prePrepareMsg.Sign, node.getPubKey(node.ClusterName, prePrepareMsg.NodeID)); err != nil {
+		return fmt.Errorf("prepared certificate has an invalid pre-prepare signature: %s", err)
+	}
+
+	voters := make(map[string]bool)
+	for _, vote := range cert.PrepareMsgs {
+		if vote.MsgType != consensus.PrepareMsg || vote.Digest != prePrepareMsg.Digest || vote.ViewID != prePrepareMsg.ViewID {
+			continue
+		}
+		if vote.ViewNumber != prePrepareMsg.ViewNumber || vote.SequenceID != prePrepareMsg.SequenceID {
+			continue
+		}
+		if !node.inCommittee(node.ClusterName, prePrepareMsg.ViewNumber, vote.NodeID) {
+			continue
+		}
+		if node.verifyVote(node.ClusterName, vote) != nil {
+			continue
+		}
+		voters[vote.NodeID] = true
+	}
+	if len(voters) < 2*clusterF(node.ClusterName) {
+		return errors.New("prepared certificate does not contain 2f prepare votes from the committee")
+	}
+	return nil
+}
+
+// signMsg 计算消息的摘要并用本节点私钥签名
+func (node *Node) signMsg(msg interface{}) (string, []byte) {
+	var digest string
+	switch m := msg.(type) {
+	case *consensus.ViewChangeMsg:
+		digest = viewChangeDigest(m)
+	case *consensus.NewViewMsg:
+		digest = newViewDigest(m)
+	case *consensus.CheckpointMsg:
+		digest = checkpointDigest(m)
+	case *consensus.RemoteViewChangeMsg:
+		digest = remoteViewChangeDigest(m)
+	case *consensus.PrimaryChangeMsg:
+		digest = primaryChangeDigest(m)
+	case *consensus.VoteMsg:
+		digest = voteDigest(m)
+	}
+	digestByte, _ := hex.DecodeString(digest)
+	return digest, node.RsaSignWithSha256(digestByte, node.rsaPrivKey)
+}
+
+// verifyVote 验证 cluster 中节点对投票的签名，签名覆盖消息类型、视图、轮次、序号和批次摘要
+func (node *Node) verifyVote(cluster string, vote *consensus.VoteMsg) error {
+	digestByte, _ := hex.DecodeString(voteDigest(vote))
+	return node.RsaVerySignWithSha256(digestByte, vote.Sign, node.getPubKey(cluster, vote.NodeID))
+}
+
+// verifyMsgSign 检查消息摘要是否与内容一致，并验证发送者的签名
+func (node *Node) verifyMsgSign(nodeID string, digestGot string, sign []byte, digest string) error {
+	if digestGot != digest {
+		return fmt.Errorf("digest of message from %s mismatch", nodeID)
+	}
+	digestByte, _ := hex.DecodeString(digest)
+	if err := node.RsaVerySignWithSha256(digestByte, sign, node.getPubKey(node.ClusterName, nodeID)); err != nil {
+		return fmt.Errorf("signature of message from %s is invalid: %s", nodeID, err)
+	}
+	return nil
+}
+
+func viewChangeDigest(msg *consensus.ViewChangeMsg) string {
+	unsigned := *msg
+	unsigned.Digest, unsigned.Sign = "", nil
+	jsonMsg, _ := json.Marshal(&unsigned)
+	return consensus.Hash(jsonMsg)
+}
+
+func newViewDigest(msg *consensus.NewViewMsg) string {
+	unsigned := *msg
+	unsigned.Digest, unsigned.Sign = "", nil
+	jsonMsg, _ := json.Marshal(&unsigned)
+	return consensus.Hash(jsonMsg)
+}
+
+// voteDigest prepare 和 commit 的签名内容。Digest 字段是批次摘要，与其余字段一起签名，
+// 防止把一种投票改成另一种类型、视图或序号的投票，commit 中的 PrepareSenders 也不能被篡改
+func voteDigest(msg *consensus.VoteMsg) string {
+	unsigned := *msg
+	unsigned.Sign = nil
+	jsonMsg, _ := json.Marshal(&unsigned)
+	return consensus.Hash(jsonMsg)
+}
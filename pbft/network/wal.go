@@ -0,0 +1,410 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"simple_pbft/pbft/consensus"
+	"sync"
+)
+
+// WALDir 预写日志所在的目录，每个节点一个文件，为空时不记录日志
+var WALDir = "wal"
+
+// 预写日志的记录类型
+const (
+	walPrePrepare = "preprepare" // 接受的 pre-prepare
+	walPrepared   = "prepared"   // prepared 证明
+	walCommitted  = "committed"  // commit 证明，本地共识完成
+	walGlobal     = "global"     // 其他集群达成本地共识的批次
+	walCheckpoint = "checkpoint" // 稳定检查点
+	walView       = "view"       // 进入新视图
+	walExecute    = "execute"    // 执行一个全局轮次
+	walSnapshot   = "snapshot"   // 从其他节点获取的快照
+)
+
+// WAL 追加写入的预写日志，每条记录是一行 JSON，写入后立即 fsync。
+// 每个稳定检查点之后日志被重写为以该检查点的快照开头
+type WAL struct {
+	file *os.File
+	path string
+	lock sync.Mutex
+}
+
+type walRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type walCommit struct {
+	SequenceID int64                `json:"sequenceID"`
+	CommitMsgs []*consensus.VoteMsg `json:"commitMsgs"`
+}
+
+type walSnapshotRecord struct {
+	Checkpoint *consensus.Checkpoint `json:"checkpoint"`
+	Snapshot   *consensus.Snapshot   `json:"snapshot"`
+}
+
+type walViewNumber struct {
+	ViewNumber int64 `json:"viewNumber"`
+}
+
+type walRound struct {
+	ViewID int64 `json:"viewID"`
+}
+
+// OpenWAL 打开(或创建)节点的预写日志
+func OpenWAL(nodeID string) (*WAL, error) {
+	if WALDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(WALDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(WALDir, nodeID+".wal")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{file: file, path: path}, nil
+}
+
+func newWALRecord(recordType string, data interface{}) (*walRecord, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &walRecord{Type: recordType, Data: jsonData}, nil
+}
+
+// Append 写入一条记录并 fsync，返回后记录已经持久化
+func (wal *WAL) Append(recordType string, data interface{}) {
+	if wal == nil {
+		return
+	}
+	record, err := newWALRecord(recordType, data)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	line, _ := json.Marshal(record)
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if _, err := wal.file.Write(append(line, '\n')); err != nil {
+		fmt.Printf("write wal: %s\n", err)
+		return
+	}
+	if err := wal.file.Sync(); err != nil {
+		fmt.Printf("sync wal: %s\n", err)
+	}
+}
+
+// Records 从头读取所有完整的记录，崩溃时写了一半的最后一条记录会被忽略
+func (wal *WAL) Records() ([]*walRecord, error) {
+	if wal == nil {
+		return nil, nil
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return wal.readRecords()
+}
+
+// readRecords 与 Records 相同，调用时需持有 lock
+func (wal *WAL) readRecords() ([]*walRecord, error) {
+	if _, err := wal.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	records := make([]*walRecord, 0)
+	reader := bufio.NewReader(wal.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println("ignore incomplete wal record")
+			}
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		record := new(walRecord)
+		if err := json.Unmarshal(line, record); err != nil {
+			fmt.Printf("ignore corrupted wal record: %s\n", err)
+			return records, nil
+		}
+		records = append(records, record)
+	}
+}
+
+// Compact 用 rewrite 返回的记录替换日志中的全部记录。新日志先写入临时文件并 fsync，再通过 rename 原子地替换旧文件，
+// 整个过程持有锁，期间不会有记录追加到旧文件中
+func (wal *WAL) Compact(rewrite func(records []*walRecord) []*walRecord) error {
+	if wal == nil {
+		return nil
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	records, err := wal.readRecords()
+	if err != nil {
+		return err
+	}
+	records = rewrite(records)
+
+	tmpPath := wal.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, wal.path); err != nil {
+		return err
+	}
+	// rename 之后同步目录，保证新文件名已经持久化
+	if dir, err := os.Open(filepath.Dir(wal.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	file, err := os.OpenFile(wal.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file.Close()
+	wal.file = file
+	return nil
+}
+
+// compactWAL 检查点 checkpoint 成为稳定检查点后重写预写日志：新日志以该检查点及本节点的快照开头，
+// 只保留快照之后仍然需要的记录，重放时从快照开始，不再从头执行所有全局轮次。
+// 本节点执行到检查点之前检查点可能已经稳定，执行后生成快照时再调用一次，调用时需持有 GlobalViewIDLock
+func (node *Node) compactWAL(checkpoint *consensus.Checkpoint) {
+	snapshot, ok := node.Snapshots[checkpoint.SequenceID]
+	// 本节点还没有执行到检查点，或者快照与稳定检查点不一致时等待状态传输
+	if !ok || snapshotDigest(snapshot) != checkpoint.Digest {
+		return
+	}
+	head, err := newWALRecord(walSnapshot, &walSnapshotRecord{Checkpoint: checkpoint, Snapshot: snapshot})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var before, after int
+	err = node.WAL.Compact(func(records []*walRecord) []*walRecord {
+		before = len(records)
+		kept := []*walRecord{head}
+		// 只保留快照之前最后一次进入的视图，之后的视图按原来的顺序保留
+		var view *walRecord
+		for _, record := range records {
+			if record.Type == walView && len(kept) == 1 {
+				view = record
+				continue
+			}
+			if record.Type != walView && !walNeeded(record, checkpoint.SequenceID, snapshot.ViewID) {
+				continue
+			}
+			if view != nil {
+				kept = append(kept, view)
+				view = nil
+			}
+			kept = append(kept, record)
+		}
+		if view != nil {
+			kept = append(kept, view)
+		}
+		after = len(kept)
+		return kept
+	})
+	if err != nil {
+		fmt.Printf("compact wal: %s\n", err)
+		return
+	}
+	fmt.Printf("压缩预写日志 %d 条 -> %d 条，从序号 %d 的快照开始\n", before, after, checkpoint.SequenceID)
+}
+
+// walNeeded 记录在序号为 stable、下一个全局轮次为 viewID 的快照之后是否仍然需要重放
+func walNeeded(record *walRecord, stable int64, viewID int64) bool {
+	switch record.Type {
+	case walPrePrepare:
+		var msg consensus.PrePrepareMsg
+		return json.Unmarshal(record.Data, &msg) == nil && msg.SequenceID > stable
+	case walPrepared:
+		var cert consensus.PreparedCert
+		return json.Unmarshal(record.Data, &cert) == nil && cert.PrePrepareMsg != nil && cert.PrePrepareMsg.SequenceID > stable
+	case walCommitted:
+		var commit walCommit
+		return json.Unmarshal(record.Data, &commit) == nil && commit.SequenceID > stable
+	case walGlobal:
+		var msg consensus.GlobalShareMsg
+		return json.Unmarshal(record.Data, &msg) == nil && msg.ViewID >= viewID
+	case walExecute:
+		var round walRound
+		return json.Unmarshal(record.Data, &round) == nil && round.ViewID >= viewID
+	case walCheckpoint:
+		var checkpoint consensus.Checkpoint
+		return json.Unmarshal(record.Data, &checkpoint) == nil && checkpoint.SequenceID > stable
+	case walSnapshot:
+		var snapshot walSnapshotRecord
+		return json.Unmarshal(record.Data, &snapshot) == nil && snapshot.Checkpoint != nil && snapshot.Checkpoint.SequenceID > stable
+	}
+	return false
+}
+
+// replayWAL 在 NewNode 中重放预写日志，恢复视图、共识实例、全局日志和状态机，重放时不发送任何消息
+func (node *Node) replayWAL() error {
+	records, err := node.WAL.Records()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	for _, record := range records {
+		if err := node.replayRecord(record); err != nil {
+			fmt.Printf("replay %s record: %s\n", record.Type, err)
+		}
+	}
+
+	// 停机期间其他节点可能已经继续前进
+	node.StateTransfer.Recovering = true
+	fmt.Printf("重放预写日志 %d 条，视图 %d，已提交序号 %d，全局轮次 %d\n",
+		len(records), node.View.Number, node.CommittedSequenceID, node.GlobalViewID)
+	// 仍有未完成的共识实例，等待其他节点的消息，超时则发起视图切换
+	if !node.readyForNewConsensus() {
+		node.startViewChangeTimer()
+	}
+	return nil
+}
+
+func (node *Node) replayRecord(record *walRecord) error {
+	switch record.Type {
+	case walPrePrepare:
+		var msg consensus.PrePrepareMsg
+		if err := json.Unmarshal(record.Data, &msg); err != nil {
+			return err
+		}
+		if msg.SequenceID <= node.CommittedSequenceID {
+			return nil
+		}
+		if _, err := node.installPrePrepare(&msg); err != nil {
+			return err
+		}
+	case walPrepared:
+		var cert consensus.PreparedCert
+		if err := json.Unmarshal(record.Data, &cert); err != nil {
+			return err
+		}
+		state := node.States[cert.PrePrepareMsg.SequenceID]
+		if state == nil {
+			return nil
+		}
+		for _, msg := range cert.PrepareMsgs {
+			state.MsgLogs.PrepareMsgs[msg.NodeID] = msg
+		}
+		state.CurrentStage = consensus.Prepared
+	case walCommitted:
+		var commit walCommit
+		if err := json.Unmarshal(record.Data, &commit); err != nil {
+			return err
+		}
+		state := node.States[commit.SequenceID]
+		if state == nil {
+			return nil
+		}
+		for _, msg := range commit.CommitMsgs {
+			state.MsgLogs.CommitMsgs[msg.NodeID] = msg
+		}
+		state.CurrentStage = consensus.Committed
+		node.replayLocalCommits()
+	case walGlobal:
+		var msg consensus.GlobalShareMsg
+		if err := json.Unmarshal(record.Data, &msg); err != nil {
+			return err
+		}
+		node.GlobalLog.SaveShare(&msg)
+	case walCheckpoint:
+		var checkpoint consensus.Checkpoint
+		if err := json.Unmarshal(record.Data, &checkpoint); err != nil {
+			return err
+		}
+		node.GlobalViewIDLock.Lock()
+		node.StableCheckpoint = &checkpoint
+		node.truncateGlobalLog()
+		node.GlobalViewIDLock.Unlock()
+		node.collectGarbage()
+	case walView:
+		var view walViewNumber
+		if err := json.Unmarshal(record.Data, &view); err != nil {
+			return err
+		}
+		primary := node.PrimaryOf(node.ClusterName, view.ViewNumber)
+		node.StatesLock.Lock()
+		node.View.Number = view.ViewNumber
+		node.View.Primary = primary
+		node.StatesLock.Unlock()
+		node.dropUncommittedStates()
+	case walExecute:
+		var round walRound
+		if err := json.Unmarshal(record.Data, &round); err != nil {
+			return err
+		}
+		node.GlobalViewIDLock.Lock()
+		defer node.GlobalViewIDLock.Unlock()
+		if round.ViewID != node.GlobalViewID {
+			return fmt.Errorf("execute round %d, expect %d", round.ViewID, node.GlobalViewID)
+		}
+		node.GlobalViewID++
+		node.executeRound(round.ViewID)
+	case walSnapshot:
+		var snapshot walSnapshotRecord
+		if err := json.Unmarshal(record.Data, &snapshot); err != nil {
+			return err
+		}
+		node.GlobalViewIDLock.Lock()
+		err := node.restoreSnapshot(snapshot.Checkpoint, snapshot.Snapshot)
+		node.GlobalViewIDLock.Unlock()
+		if err != nil {
+			return err
+		}
+		node.collectGarbage()
+	default:
+		return fmt.Errorf("unknown record type")
+	}
+	return nil
+}
+
+// replayLocalCommits 与 commitInOrder 相同地按序号提交，但不向其他节点发送消息
+func (node *Node) replayLocalCommits() {
+	for {
+		state, ok := node.States[node.CommittedSequenceID+1]
+		if !ok || state.CurrentStage != consensus.Committed {
+			return
+		}
+		node.GlobalLog.Save(node.ClusterName, node.View.ID, state.MsgLogs.ReqMsg)
+		node.GlobalLog.SaveCert(node.View.ID, state.CommitCert())
+		node.StatesLock.Lock()
+		node.CommittedSequenceID++
+		node.View.ID++
+		node.StatesLock.Unlock()
+	}
+}
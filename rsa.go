@@ -8,26 +8,27 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"simple_pbft/pbft/network"
 	"strconv"
 )
 
-// 如果当前目录下不存在目录Keys，则创建目录，并为各个节点生成rsa公私钥
+// 如果 network.KeysDir 下不存在集群的目录，则创建目录，并为各个节点生成rsa公私钥
 func genRsaKeys(ClusterName string) {
-	if !isExist("./Keys/" + ClusterName) {
+	if !isExist(network.KeysDir + "/" + ClusterName) {
 		fmt.Println("检测到还未生成公私钥目录，正在生成公私钥 ...")
-		err := os.Mkdir("Keys/"+ClusterName, 0644)
+		err := os.Mkdir(network.KeysDir+"/"+ClusterName, 0644)
 		if err != nil {
 			log.Panic()
 		}
 		for i := 0; i <= 150; i++ {
-			if !isExist("./Keys/" + ClusterName + "/" + ClusterName + strconv.Itoa(i)) {
-				err := os.Mkdir("./Keys/"+ClusterName+"/"+ClusterName+strconv.Itoa(i), 0644)
+			if !isExist(network.KeysDir + "/" + ClusterName + "/" + ClusterName + strconv.Itoa(i)) {
+				err := os.Mkdir(network.KeysDir+"/"+ClusterName+"/"+ClusterName+strconv.Itoa(i), 0644)
 				if err != nil {
 					log.Panic()
 				}
 			}
 			priv, pub := getKeyPair()
-			privFileName := "./Keys/" + ClusterName + "/" + ClusterName + strconv.Itoa(i) + "/" + ClusterName + strconv.Itoa(i) + "_RSA_PIV"
+			privFileName := network.KeysDir + "/" + ClusterName + "/" + ClusterName + strconv.Itoa(i) + "/" + ClusterName + strconv.Itoa(i) + "_RSA_PIV"
 			file, err := os.OpenFile(privFileName, os.O_RDWR|os.O_CREATE, 0644)
 			if err != nil {
 				log.Panic(err)
@@ -35,7 +36,7 @@ func genRsaKeys(ClusterName string) {
 			defer file.Close()
 			file.Write(priv)
 
-			pubFileName := "./Keys/" + ClusterName + "/" + ClusterName + strconv.Itoa(i) + "/" + ClusterName + strconv.Itoa(i) + "_RSA_PUB"
+			pubFileName := network.KeysDir + "/" + ClusterName + "/" + ClusterName + strconv.Itoa(i) + "/" + ClusterName + strconv.Itoa(i) + "_RSA_PUB"
 			file2, err := os.OpenFile(pubFileName, os.O_RDWR|os.O_CREATE, 0644)
 			if err != nil {
 				log.Panic(err)